@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"github.com/jmoiron/jsonq"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// controlTokenHeader on otsake, jossa ohjauspyynnöt (käsiohjaus, kameroiden käytöstä poisto ja
+// uudelleenlataus) kertovat pkm.json:n control_token-arvon
+const controlTokenHeader = "X-PKM-Token"
+
+// requireControl suojaa lähetystä ohjaavat rajapinnat. Jos control_token on konfiguroitu, pyynnössä
+// pitää olla sama token X-PKM-Token-otsakkeessa, muuten ohjaus sallitaan vain PKM-koneelta itseltään.
+// Toiselta sivustolta lähtöisin olevat selainpyynnöt hylätään aina Origin-otsakkeen perusteella,
+// jottei mikä tahansa operaattorin selaimessa auki oleva sivu voi ohjata kameroita.
+func requireControl(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("Origin"); origin != "" {
+			if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+				log.Printf("Ohjauspyyntö %s %s hylättiin, lähde %s ei ole PKM", r.Method, r.URL.Path, origin)
+				http.Error(w, "ohjauspyyntö toiselta sivustolta", http.StatusForbidden)
+				return
+			}
+		}
+
+		if token := store.ControlToken(); token != "" {
+			given := r.Header.Get(controlTokenHeader)
+			if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				log.Printf("Ohjauspyyntö %s %s osoitteesta %s hylättiin, token puuttuu tai on virheellinen", r.Method, r.URL.Path, r.RemoteAddr)
+				http.Error(w, "ohjaustoken puuttuu tai on virheellinen", http.StatusUnauthorized)
+				return
+			}
+		} else if !isLoopback(r.RemoteAddr) {
+			log.Printf("Ohjauspyyntö %s %s osoitteesta %s hylättiin, control_token ei ole käytössä", r.Method, r.URL.Path, r.RemoteAddr)
+			http.Error(w, "ohjaus sallitaan muualta kuin PKM-koneelta vain control_token-asetuksella", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	})
+}
+
+func isLoopback(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func configureControl() {
+	token, err := loadControlToken(CQ)
+	if err != nil {
+		log.Fatal(err)
+	}
+	store.SetControlToken(token)
+	if token == "" {
+		log.Println("control_token ei ole käytössä, käsiohjaus ja uudelleenlataus sallitaan vain PKM-koneelta")
+	}
+}
+
+// loadControlToken lukee ohjausrajapintojen tokenin. Puuttuva token rajaa ohjauksen PKM-koneelle,
+// mutta virheellinen arvo on virhe, jottei kirjoitusvirhe avaa ohjausta.
+func loadControlToken(cq *jsonq.JsonQuery) (string, error) {
+	if _, err := cq.Interface("control_token"); err != nil {
+		return "", nil
+	}
+	token, err := cq.String("control_token")
+	if err != nil || token == "" {
+		return "", fmt.Errorf("Virheellinen control_token, odotettiin ei-tyhjää merkkijonoa")
+	}
+	return token, nil
+}
@@ -0,0 +1,75 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestRequireControl tarkistaa ohjausrajapintojen suojauksen tokenilla ja ilman
+func TestRequireControl(t *testing.T) {
+	store = newStateStore()
+	handler := requireControl(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	request := func(remote, origin, token string) int {
+		r := httptest.NewRequest("POST", "http://pkm:1999/override/lock", nil)
+		r.RemoteAddr = remote
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		if token != "" {
+			r.Header.Set(controlTokenHeader, token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	for _, c := range []struct {
+		token, remote, origin, given string
+		want                         int
+	}{
+		{"", "127.0.0.1:5000", "", "", http.StatusNoContent},
+		{"", "[::1]:5000", "http://pkm:1999", "", http.StatusNoContent},
+		{"", "192.168.1.20:5000", "", "", http.StatusForbidden},
+		{"", "192.168.1.20:5000", "", "arvaus", http.StatusForbidden},
+		{"", "127.0.0.1:5000", "http://pahantahtoinen.example", "", http.StatusForbidden},
+		{"salainen", "192.168.1.20:5000", "", "salainen", http.StatusNoContent},
+		{"salainen", "192.168.1.20:5000", "http://pkm:1999", "salainen", http.StatusNoContent},
+		{"salainen", "192.168.1.20:5000", "", "väärä", http.StatusUnauthorized},
+		{"salainen", "127.0.0.1:5000", "", "", http.StatusUnauthorized},
+		{"salainen", "192.168.1.20:5000", "http://pahantahtoinen.example", "salainen", http.StatusForbidden},
+	} {
+		store.SetControlToken(c.token)
+		if got := request(c.remote, c.origin, c.given); got != c.want {
+			t.Errorf("token %q, osoite %s, origin %q, annettu token %q: vastaus %d, odotettiin %d",
+				c.token, c.remote, c.origin, c.given, got, c.want)
+		}
+	}
+}
+
+func TestLoadControlToken(t *testing.T) {
+	for config, want := range map[string]string{
+		`{}`:                            "",
+		`{"control_token": "salainen"}`: "salainen",
+	} {
+		cq, err := DecodeJsonToJsonQ(strings.NewReader(config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := loadControlToken(cq); err != nil || got != want {
+			t.Errorf("konfiguraatio %s: token %q, virhe %v", config, got, err)
+		}
+	}
+	for _, config := range []string{`{"control_token": ""}`, `{"control_token": 1234}`, `{"control_token": ["salainen"]}`} {
+		cq, err := DecodeJsonToJsonQ(strings.NewReader(config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadControlToken(cq); err == nil {
+			t.Errorf("konfiguraatio %s hyväksyttiin", config)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package internal
+
+import "net/http"
+
+// ServeDashboard palauttaa operaattorin selainkäyttöliittymän. Sivu hakee tilan /ws-yhteyden
+// snapshotista ja päivittyy sen tapahtumista, käsiohjaus ja kameroiden käytöstä poisto tehdään
+// samoilla rajapinnoilla kuin muistakin järjestelmistä.
+func ServeDashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(dashboardHTML))
+}
+
+// dashboardHTML on koko käyttöliittymä yhtenä sivuna, jotta pkm.exe toimii ilman erillisiä tiedostoja
+const dashboardHTML = `<!DOCTYPE html>
+<html lang="fi">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>PKM</title>
+<style>
+body { font-family: sans-serif; margin: 0; background: #1d1f21; color: #e0e0e0; }
+header { display: flex; gap: 2em; align-items: center; padding: .6em 1em; background: #111; }
+header h1 { margin: 0; font-size: 1.3em; }
+main { padding: 1em; display: grid; gap: 1em; grid-template-columns: 1fr 1fr; }
+section { background: #282a2e; border-radius: 4px; padding: .8em; }
+section.wide { grid-column: 1 / 3; }
+h2 { margin: 0 0 .5em 0; font-size: 1.1em; }
+table { width: 100%; border-collapse: collapse; }
+th, td { text-align: left; padding: .3em .4em; border-bottom: 1px solid #3a3d42; }
+th { font-weight: normal; color: #999; }
+td.sid { font-family: monospace; font-size: .85em; color: #aaa; }
+tr.onair td { background: #8b1c1c; color: #fff; }
+tr.observed td:first-child { border-left: 4px solid #e0b030; }
+tr.disabled td { color: #777; text-decoration: line-through; }
+tr.disabled td:last-child { text-decoration: none; }
+button { background: #3a3d42; color: #e0e0e0; border: 1px solid #555; border-radius: 3px; padding: .2em .6em; cursor: pointer; }
+button:hover { background: #4a4e54; }
+.ok { color: #5fbf5f; }
+.warn { color: #e0b030; }
+.bad { color: #e05050; }
+#onair { font-size: 1.6em; }
+#override button { margin-right: .5em; }
+</style>
+</head>
+<body>
+<header>
+  <h1>PKM</h1>
+  <span>Yhteys: <span id="connection" class="bad">ei yhteyttä</span></span>
+  <span>Viimeisin GSI-paketti: <span id="gsiage">-</span></span>
+  <span>GSI-paketteja: <span id="gsicount">-</span></span>
+</header>
+<main>
+  <section class="wide">
+    <h2>Lähetyksessä</h2>
+    <div id="onair">-</div>
+    <p>Observer katsoo: <span id="observed">-</span></p>
+    <div id="override">
+      Käsiohjaus: <strong id="overridemode">-</strong>
+      <button id="lock">Lukitse kamera</button>
+      <button id="release">Palauta observerille</button>
+    </div>
+  </section>
+  <section>
+    <h2>Joukkue A</h2>
+    <table><thead><tr><th>Paikka</th><th>Pelaaja</th><th>SteamID</th><th>Kamera</th><th></th></tr></thead><tbody id="teamA"></tbody></table>
+  </section>
+  <section>
+    <h2>Joukkue B</h2>
+    <table><thead><tr><th>Paikka</th><th>Pelaaja</th><th>SteamID</th><th>Kamera</th><th></th></tr></thead><tbody id="teamB"></tbody></table>
+  </section>
+  <section class="wide">
+    <h2>Pelaajat ilman kameraa</h2>
+    <table><thead><tr><th>Pelaaja</th><th>SteamID</th></tr></thead><tbody id="nocamera"></tbody></table>
+  </section>
+  <section class="wide">
+    <h2>OBS-palvelimet</h2>
+    <table><thead><tr><th>Palvelin</th><th>Protokolla</th><th>Tila</th><th>Alkaen</th><th>Uudelleenyhdistämiset</th><th>Viimeisin virhe</th><th>Kameravirheet</th></tr></thead><tbody id="servers"></tbody></table>
+  </section>
+</main>
+<script>
+"use strict";
+
+var state = { players: {}, observed: {}, onAir: {}, servers: [], gsi: {}, override: { mode: "-" } };
+
+function el(tag, text, cls) {
+  var e = document.createElement(tag);
+  if (text !== undefined && text !== null) { e.textContent = text; }
+  if (cls) { e.className = cls; }
+  return e;
+}
+
+// post lähettää ohjauspyynnön. Jos PKM vaatii control_token-tokenin, se kysytään kerran ja
+// tallennetaan selaimeen.
+function post(url, retried) {
+  var headers = {};
+  var token = localStorage.getItem("pkm-token");
+  if (token) { headers["X-PKM-Token"] = token; }
+  return fetch(url, { method: "POST", headers: headers }).then(function (resp) {
+    if (resp.status === 401 && !retried) {
+      token = prompt("PKM:n control_token");
+      if (token) {
+        localStorage.setItem("pkm-token", token);
+        return post(url, true);
+      }
+    }
+    return resp.text().then(function (body) {
+      if (!resp.ok) { alert(body); throw new Error(body); }
+      return body ? JSON.parse(body) : null;
+    });
+  });
+}
+
+function refreshOverride() {
+  fetch("/state").then(function (resp) { return resp.json(); }).then(function (s) {
+    state.override = s.override;
+    render();
+  });
+}
+
+function playerRow(sid, p) {
+  var tr = el("tr");
+  if (sid === state.onAir.steamid && state.onAir.camera) { tr.className = "onair"; }
+  if (sid === state.observed.steamid) { tr.className += " observed"; }
+  if (p.disabled) { tr.className += " disabled"; }
+  tr.appendChild(el("td", p.place));
+  tr.appendChild(el("td", p.player_name));
+  tr.appendChild(el("td", sid, "sid"));
+  tr.appendChild(el("td", p.camera));
+  var actions = el("td");
+  var force = el("button", "Lähetykseen");
+  force.disabled = p.disabled;
+  force.onclick = function () {
+    post("/override/camera/" + encodeURIComponent(p.camera)).then(function (o) { state.override = o; render(); });
+  };
+  var toggle = el("button", p.disabled ? "Palauta käyttöön" : "Poista käytöstä");
+  toggle.onclick = function () {
+    post("/cameras/" + encodeURIComponent(p.camera) + (p.disabled ? "/enable" : "/disable"));
+  };
+  actions.appendChild(force);
+  actions.appendChild(toggle);
+  tr.appendChild(actions);
+  return tr;
+}
+
+function renderPlayers() {
+  var teams = { A: [], B: [] };
+  var nocamera = document.getElementById("nocamera");
+  nocamera.textContent = "";
+  Object.keys(state.players).forEach(function (sid) {
+    var p = state.players[sid];
+    var team = p.seat ? p.seat.charAt(0) : "";
+    if (p.camera && teams[team]) {
+      teams[team].push([sid, p]);
+    } else {
+      var tr = el("tr");
+      tr.appendChild(el("td", p.player_name));
+      tr.appendChild(el("td", sid, "sid"));
+      nocamera.appendChild(tr);
+    }
+  });
+  ["A", "B"].forEach(function (team) {
+    var body = document.getElementById("team" + team);
+    body.textContent = "";
+    teams[team].sort(function (a, b) { return a[1].place - b[1].place; });
+    teams[team].forEach(function (entry) { body.appendChild(playerRow(entry[0], entry[1])); });
+  });
+}
+
+function renderServers() {
+  var body = document.getElementById("servers");
+  body.textContent = "";
+  state.servers.forEach(function (s) {
+    var tr = el("tr");
+    tr.appendChild(el("td", s.address));
+    tr.appendChild(el("td", s.protocol));
+    tr.appendChild(el("td", s.state, s.state === "up" ? "ok" : (s.state === "connecting" ? "warn" : "bad")));
+    tr.appendChild(el("td", s.since ? new Date(s.since).toLocaleTimeString() : "-"));
+    tr.appendChild(el("td", s.reconnects));
+    tr.appendChild(el("td", s.last_error || ""));
+    var errors = s.camera_errors ? Object.keys(s.camera_errors) : [];
+    tr.appendChild(el("td", errors.join(", "), errors.length ? "bad" : ""));
+    body.appendChild(tr);
+  });
+}
+
+function describe(p) {
+  if (!p || !p.steamid || p.steamid === "0") { return "tuntematon pelaaja"; }
+  return (p.player_name || p.steamid) + (p.camera ? " (" + p.camera + ")" : "");
+}
+
+function renderGSIAge() {
+  var age = document.getElementById("gsiage");
+  if (!state.gsi.last_packet) { age.textContent = "ei vielä yhtään"; age.className = "bad"; return; }
+  var seconds = Math.round((Date.now() - new Date(state.gsi.last_packet).getTime()) / 1000);
+  age.textContent = seconds + " s sitten";
+  age.className = seconds < 5 ? "ok" : (seconds < 30 ? "warn" : "bad");
+}
+
+function render() {
+  document.getElementById("onair").textContent = state.onAir.camera ? describe(state.onAir) : "kaikki kamerat piilotettu";
+  document.getElementById("observed").textContent = describe(state.observed);
+  document.getElementById("overridemode").textContent = { auto: "automaattinen", forced: "pakotettu", locked: "lukittu" }[state.override.mode] || state.override.mode;
+  document.getElementById("gsicount").textContent = state.gsi.accepted === undefined ? "-" : state.gsi.accepted + " hyväksytty, " + (state.gsi.received - state.gsi.accepted) + " hylätty";
+  renderPlayers();
+  renderServers();
+  renderGSIAge();
+}
+
+function connect() {
+  var ws = new WebSocket((location.protocol === "https:" ? "wss://" : "ws://") + location.host + "/ws");
+  var connection = document.getElementById("connection");
+  ws.onopen = function () { connection.textContent = "yhdistetty"; connection.className = "ok"; };
+  ws.onclose = function () {
+    connection.textContent = "ei yhteyttä";
+    connection.className = "bad";
+    setTimeout(connect, 2000);
+  };
+  ws.onmessage = function (msg) {
+    var ev = JSON.parse(msg.data);
+    switch (ev.type) {
+    case "snapshot":
+      state.players = ev.data.players;
+      state.observed = ev.data.observed;
+      state.onAir = ev.data.on_air;
+      state.servers = ev.data.camera_servers;
+      state.gsi = ev.data.gsi;
+      state.override = ev.data.state.override;
+      break;
+    case "observed_player":
+      state.observed = ev.data;
+      break;
+    case "camera_on_air":
+      state.onAir = ev.data;
+      refreshOverride();
+      break;
+    case "roster":
+      state.players = ev.data;
+      break;
+    case "obs_server":
+      var replaced = false;
+      state.servers = state.servers.map(function (s) {
+        if (s.address === ev.data.address) { replaced = true; return ev.data; }
+        return s;
+      });
+      if (!replaced) { state.servers.push(ev.data); }
+      break;
+    case "gsi_heartbeat":
+      state.gsi = ev.data;
+      break;
+    }
+    render();
+  };
+}
+
+document.getElementById("lock").onclick = function () {
+  post("/override/lock").then(function (o) { state.override = o; render(); });
+};
+document.getElementById("release").onclick = function () {
+  post("/override/release").then(function (o) { state.override = o; render(); });
+};
+setInterval(renderGSIAge, 1000);
+render();
+connect();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"strings"
+)
+
+type (
+	// playerStatus on /players-rajapinnan pelaajamerkintä: konfiguraation tiedot ja ajonaikainen tila
+	playerStatus struct {
+		Player
+		Seat     string `json:"seat,omitempty"`
+		Disabled bool   `json:"disabled"`
+	}
+
+	cameraState struct {
+		Camera   string `json:"camera"`
+		Seat     string `json:"seat,omitempty"`
+		Disabled bool   `json:"disabled"`
+	}
+)
+
+// playerStatuses palauttaa rosterin pelaajat käytöstä poistettujen kameroiden tiedoilla
+func playerStatuses() map[SteamID64]playerStatus {
+	roster := store.Roster()
+	players := make(map[SteamID64]playerStatus, roster.Len())
+	roster.Each(func(id SteamID64, p Player) {
+		players[id] = playerStatus{Player: p, Seat: p.Seat(), Disabled: p.Camera != "" && store.CameraDisabled(p.Camera)}
+	})
+	return players
+}
+
+// SetCameraEnabled poistaa kameran käytöstä tai palauttaa sen käyttöön: POST /cameras/{camera}/disable|enable
+func SetCameraEnabled(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	camera := vars["camera"]
+	id, p, ok := store.Roster().ByCamera(camera)
+	if !ok {
+		http.Error(w, "tuntematon kamera "+camera, http.StatusNotFound)
+		return
+	}
+	setCameraDisabled(w, id, p, vars["action"] == "disable")
+}
+
+// SetSeatEnabled poistaa paikan kameran käytöstä tai palauttaa sen käyttöön: POST /seats/{seat}/disable|enable
+func SetSeatEnabled(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	seat := strings.ToUpper(vars["seat"])
+	id, p, ok := store.Roster().BySeat(seat)
+	if !ok || p.Camera == "" {
+		http.Error(w, "paikalla "+seat+" ei ole kameraa", http.StatusNotFound)
+		return
+	}
+	setCameraDisabled(w, id, p, vars["action"] == "disable")
+}
+
+func setCameraDisabled(w http.ResponseWriter, id SteamID64, p Player, disabled bool) {
+	if store.SetCameraDisabled(p.Camera, disabled) {
+		if disabled {
+			log.Printf("Kamera %s (%s) poistettu käytöstä", p.Camera, p.PlayerName)
+		} else {
+			log.Printf("Kamera %s (%s) palautettu käyttöön", p.Camera, p.PlayerName)
+		}
+		switcher.cameraChanged(id)
+		publishRoster()
+	}
+
+	s, err := json.MarshalIndent(cameraState{Camera: p.Camera, Seat: p.Seat(), Disabled: disabled}, "", "    ")
+	if err != nil {
+		log.Println("Kameran tilan JSON-käännös epäonnistui: ", err)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(s)
+}
@@ -0,0 +1,166 @@
+package gsi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+type (
+	// State on yksi CS:GO:n Game State Integration -paketti. Paketissa on mukana vain
+	// GSI-asetustiedoston data-lohkossa pyydetyt osat, joten kaikki kentät ovat valinnaisia.
+	State struct {
+		Provider        *Provider          `json:"provider,omitempty"`
+		Map             *Map               `json:"map,omitempty"`
+		Round           *Round             `json:"round,omitempty"`
+		Player          *Player            `json:"player,omitempty"`
+		AllPlayers      map[string]Player  `json:"allplayers,omitempty"`
+		Bomb            *Bomb              `json:"bomb,omitempty"`
+		Grenades        map[string]Grenade `json:"grenades,omitempty"`
+		PhaseCountdowns *PhaseCountdowns   `json:"phase_countdowns,omitempty"`
+		Auth            *Auth              `json:"auth,omitempty"`
+
+		// Edellisestä paketista muuttuneet ja lisätyt kentät, rakenne vaihtelee paketista toiseen
+		Previously json.RawMessage `json:"previously,omitempty"`
+		Added      json.RawMessage `json:"added,omitempty"`
+	}
+
+	// Auth sisältää GSI-asetustiedoston auth-lohkon arvot
+	Auth struct {
+		Token string `json:"token"`
+	}
+
+	Provider struct {
+		Name      string `json:"name"`
+		AppID     int    `json:"appid"`
+		Version   int    `json:"version"`
+		SteamID   string `json:"steamid"`
+		Timestamp int64  `json:"timestamp"`
+	}
+
+	Map struct {
+		Mode                  string            `json:"mode"`
+		Name                  string            `json:"name"`
+		Phase                 string            `json:"phase"`
+		Round                 int               `json:"round"`
+		TeamCT                Team              `json:"team_ct"`
+		TeamT                 Team              `json:"team_t"`
+		NumMatchesToWinSeries int               `json:"num_matches_to_win_series"`
+		CurrentSpectators     int               `json:"current_spectators"`
+		SouvenirsTotal        int               `json:"souvenirs_total"`
+		RoundWins             map[string]string `json:"round_wins,omitempty"`
+	}
+
+	Team struct {
+		Score                  int    `json:"score"`
+		ConsecutiveRoundLosses int    `json:"consecutive_round_losses"`
+		TimeoutsRemaining      int    `json:"timeouts_remaining"`
+		MatchesWonThisSeries   int    `json:"matches_won_this_series"`
+		Name                   string `json:"name,omitempty"`
+		Flag                   string `json:"flag,omitempty"`
+	}
+
+	Round struct {
+		Phase   string `json:"phase"`
+		Bomb    string `json:"bomb,omitempty"`
+		WinTeam string `json:"win_team,omitempty"`
+	}
+
+	// Player on observoitava pelaaja (player) tai yksi allplayers-listan pelaajista, jolloin
+	// SteamID on listan avaimena eikä tietueessa
+	Player struct {
+		SteamID      string            `json:"steamid,omitempty"`
+		Clan         string            `json:"clan,omitempty"`
+		Name         string            `json:"name"`
+		ObserverSlot *int              `json:"observer_slot,omitempty"`
+		Team         string            `json:"team,omitempty"`
+		Activity     string            `json:"activity,omitempty"`
+		State        *PlayerState      `json:"state,omitempty"`
+		MatchStats   *MatchStats       `json:"match_stats,omitempty"`
+		Weapons      map[string]Weapon `json:"weapons,omitempty"`
+		Position     string            `json:"position,omitempty"`
+		Forward      string            `json:"forward,omitempty"`
+	}
+
+	PlayerState struct {
+		Health        int  `json:"health"`
+		Armor         int  `json:"armor"`
+		Helmet        bool `json:"helmet"`
+		Defusekit     bool `json:"defusekit,omitempty"`
+		Flashed       int  `json:"flashed"`
+		Smoked        int  `json:"smoked"`
+		Burning       int  `json:"burning"`
+		Money         int  `json:"money"`
+		RoundKills    int  `json:"round_kills"`
+		RoundKillHS   int  `json:"round_killhs"`
+		RoundTotalDmg int  `json:"round_totaldmg"`
+		EquipValue    int  `json:"equip_value"`
+	}
+
+	MatchStats struct {
+		Kills   int `json:"kills"`
+		Assists int `json:"assists"`
+		Deaths  int `json:"deaths"`
+		MVPs    int `json:"mvps"`
+		Score   int `json:"score"`
+	}
+
+	Weapon struct {
+		Name        string `json:"name"`
+		Paintkit    string `json:"paintkit"`
+		Type        string `json:"type,omitempty"`
+		AmmoClip    int    `json:"ammo_clip,omitempty"`
+		AmmoClipMax int    `json:"ammo_clip_max,omitempty"`
+		AmmoReserve int    `json:"ammo_reserve,omitempty"`
+		State       string `json:"state"`
+	}
+
+	// Bomb ja Grenade -tietueissa sijainnit, ajat ja laskurit tulevat pelistä merkkijonoina
+	Bomb struct {
+		State     string `json:"state"`
+		Position  string `json:"position,omitempty"`
+		Player    string `json:"player,omitempty"`
+		Countdown string `json:"countdown,omitempty"`
+	}
+
+	Grenade struct {
+		Owner      ID                `json:"owner"`
+		Type       string            `json:"type"`
+		Position   string            `json:"position,omitempty"`
+		Velocity   string            `json:"velocity,omitempty"`
+		Lifetime   string            `json:"lifetime"`
+		EffectTime string            `json:"effecttime,omitempty"`
+		Flames     map[string]string `json:"flames,omitempty"`
+	}
+
+	PhaseCountdowns struct {
+		Phase       string `json:"phase"`
+		PhaseEndsIn string `json:"phase_ends_in"`
+	}
+
+	// ID on tunniste, jonka peli lähettää joko merkkijonona tai numerona
+	ID string
+)
+
+// Decode lukee yhden GSI-paketin. Rakenteeltaan virheellisestä paketista palautetaan virhe.
+func Decode(r io.Reader) (*State, error) {
+	var s State
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (id *ID) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*id = ID(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return fmt.Errorf("tunniste ei ole merkkijono eikä numero: %s", data)
+	}
+	*id = ID(n.String())
+	return nil
+}
@@ -0,0 +1,157 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// histogram on Prometheus-histogrammi kumulatiivisilla lokeroilla
+	histogram struct {
+		bounds []float64
+		counts []uint64
+		sum    float64
+		count  uint64
+	}
+
+	// pkmMetrics kerää /metrics-rajapinnan mittarit, joita ei voi lukea suoraan muusta tilasta
+	pkmMetrics struct {
+		mu       sync.Mutex
+		started  time.Time
+		switches map[string]uint64
+		latency  histogram
+	}
+)
+
+// GSI-paketin vastaanotosta OBS-komennon valmistumiseen kuluvan ajan lokerot sekunteina
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+var metrics = &pkmMetrics{
+	started:  time.Now(),
+	switches: make(map[string]uint64),
+	latency:  histogram{bounds: latencyBuckets, counts: make([]uint64, len(latencyBuckets))},
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// cameraSwitched laskee kameran tuonnin lähetykseen
+func (m *pkmMetrics) cameraSwitched(camera string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.switches[camera]++
+}
+
+// switchLatency kirjaa ajan GSI-paketin vastaanotosta siihen, että sen aiheuttama kameranvaihto
+// on lähetetty OBS:lle. Jos switching-asetukset viivästivät vaihtoa, aika mitataan viiveiden
+// päättymisestä, eikä häivytyksen kestoa lasketa mukaan.
+func (m *pkmMetrics) switchLatency(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.latency.observe(d.Seconds())
+}
+
+// ReportMetrics kertoo mittarit Prometheuksen tekstimuodossa
+func ReportMetrics(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	packets := packetStats.status()
+
+	writeMetric(&buf, "pkm_gsi_packets_received_total", "counter", "Vastaanotetut GSI-paketit.")
+	fmt.Fprintf(&buf, "pkm_gsi_packets_received_total %d\n", packets.Received)
+	writeMetric(&buf, "pkm_gsi_packets_accepted_total", "counter", "Hyväksytyt GSI-paketit.")
+	fmt.Fprintf(&buf, "pkm_gsi_packets_accepted_total %d\n", packets.Accepted)
+	writeMetric(&buf, "pkm_gsi_packets_rejected_total", "counter", "Hylätyt GSI-paketit syyn mukaan.")
+	for _, reason := range []string{rejectMethod, rejectReadError, rejectMalformed, rejectUnauthorized, rejectPanic} {
+		fmt.Fprintf(&buf, "pkm_gsi_packets_rejected_total{reason=%s} %d\n", labelValue(reason), packets.Rejected[reason])
+	}
+
+	// Ennen ensimmäistä pakettia ikä lasketaan PKM:n käynnistyksestä, jotta hälytys toimii myös
+	// silloin, kun observer ei ole lähettänyt mitään
+	last := metrics.started
+	if packets.LastPacket != nil {
+		last = *packets.LastPacket
+	}
+	writeMetric(&buf, "pkm_gsi_last_packet_age_seconds", "gauge", "Aika viimeisimmästä hyväksytystä GSI-paketista.")
+	fmt.Fprintf(&buf, "pkm_gsi_last_packet_age_seconds %s\n", formatFloat(time.Since(last).Seconds()))
+
+	metrics.mu.Lock()
+	cameras := make([]string, 0, len(metrics.switches))
+	for camera := range metrics.switches {
+		cameras = append(cameras, camera)
+	}
+	sort.Strings(cameras)
+	writeMetric(&buf, "pkm_camera_switches_total", "counter", "Kameran tuonnit lähetykseen.")
+	for _, camera := range cameras {
+		fmt.Fprintf(&buf, "pkm_camera_switches_total{camera=%s} %d\n", labelValue(camera), metrics.switches[camera])
+	}
+	writeMetric(&buf, "pkm_gsi_to_obs_latency_seconds", "histogram", "Aika GSI-paketin vastaanotosta sen aiheuttaman kameranvaihdon OBS-komentoihin.")
+	for i, bound := range metrics.latency.bounds {
+		fmt.Fprintf(&buf, "pkm_gsi_to_obs_latency_seconds_bucket{le=%s} %d\n", labelValue(formatFloat(bound)), metrics.latency.counts[i])
+	}
+	fmt.Fprintf(&buf, "pkm_gsi_to_obs_latency_seconds_bucket{le=\"+Inf\"} %d\n", metrics.latency.count)
+	fmt.Fprintf(&buf, "pkm_gsi_to_obs_latency_seconds_sum %s\n", formatFloat(metrics.latency.sum))
+	fmt.Fprintf(&buf, "pkm_gsi_to_obs_latency_seconds_count %d\n", metrics.latency.count)
+	metrics.mu.Unlock()
+
+	// Mittarien nimet ovat ajalta, jolloin kaikki videolähdöt olivat OBS-palvelimia
+	servers := outputStatuses()
+	writeMetric(&buf, "pkm_obs_requests_sent_total", "counter", "Videolähdölle lähetetyt pyynnöt.")
+	for _, s := range servers {
+		fmt.Fprintf(&buf, "pkm_obs_requests_sent_total{server=%s} %d\n", labelValue(s.Address), s.RequestsSent)
+	}
+	writeMetric(&buf, "pkm_obs_requests_failed_total", "counter", "Epäonnistuneet tai vastauksetta jääneet videolähdön pyynnöt.")
+	for _, s := range servers {
+		fmt.Fprintf(&buf, "pkm_obs_requests_failed_total{server=%s} %d\n", labelValue(s.Address), s.RequestsFailed)
+	}
+	writeMetric(&buf, "pkm_obs_connection_up", "gauge", "1 jos videolähtö on käytettävissä.")
+	for _, s := range servers {
+		fmt.Fprintf(&buf, "pkm_obs_connection_up{server=%s} %d\n", labelValue(s.Address), boolMetric(s.State == outputUp))
+	}
+	writeMetric(&buf, "pkm_obs_connection_state", "gauge", "Videolähdön tila, 1 nykyiselle tilalle.")
+	for _, s := range servers {
+		for _, state := range []string{outputConnecting, outputUp, outputDown} {
+			fmt.Fprintf(&buf, "pkm_obs_connection_state{server=%s,state=%s} %d\n", labelValue(s.Address), labelValue(state), boolMetric(s.State == state))
+		}
+	}
+	writeMetric(&buf, "pkm_obs_reconnects_total", "counter", "Uudelleenyhdistämiset videolähtöön.")
+	for _, s := range servers {
+		fmt.Fprintf(&buf, "pkm_obs_reconnects_total{server=%s} %d\n", labelValue(s.Address), s.Reconnects)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+func writeMetric(buf *bytes.Buffer, name, kind, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// labelValue lainaa ja escapoi labelin arvon tekstimuodon sääntöjen mukaan
+func labelValue(v string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v) + `"`
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func boolMetric(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
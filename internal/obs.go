@@ -1,115 +1,234 @@
 package internal
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
-	"github.com/jmoiron/jsonq"
-
 	"fmt"
 	"github.com/gorilla/websocket"
+	"github.com/jmoiron/jsonq"
 	"log"
 	"net/url"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSceneName      = "Scene1"
+	defaultCameraTemplate = "{team}{place}"
 )
 
 type (
 	Config struct {
 		TeamAFile *string
 		TeamBFile *string
-		TestOnly  *bool
+		DryRun    *bool
+		Strict    *bool
 	}
 
+	// obsServer on OBS-palvelin videolähtönä. Jos palvelimelle ei ole määritelty teams- tai
+	// cameras-kenttää, kamerat haetaan OBS:n scenestä yhdistettäessä.
 	obsServer struct {
-		address    string
-		port       string
-		connection *websocket.Conn
+		outputRouting
+		address  string
+		port     string
+		password string
+		protocol obsProtocol
+		scene    string
+
+		// mu suojaa yhteyttä, odottavia pyyntöjä ja terveystietoja, sillä komentoja lähetetään
+		// HTTP-käsittelijöistä ja yhteyttä avataan uudelleen valvontagoroutinesta
+		mu           sync.Mutex
+		connection   *obsConnection
+		nextID       int
+		health       outputHealth
+		cameraErrors map[string]string
+		broken       chan error
+		// stop suljetaan Stop-kutsulla ja stopped valvontagoroutinen päätyttyä
+		stop    chan struct{}
+		stopped chan struct{}
+		// Pyyntölaskurit /metrics-rajapinnalle
+		requestsSent   uint64
+		requestsFailed uint64
+	}
+
+	// obsProtocol kätkee obs-websocket -protokollaversioiden (4.x ja 5.x) erot
+	obsProtocol interface {
+		name() string
+		// handshake suoritetaan ennen kuin yhteyden lukijagoroutine käynnistyy
+		handshake(conn *websocket.Conn, password string) error
+		encodeRequest(id, requestType string, data map[string]interface{}) interface{}
+		// decodeResponse palauttaa ok == false viesteille, jotka eivät ole vastauksia pyyntöihin
+		decodeResponse(raw []byte) (resp obsResponse, ok bool)
+		setVisibility(ctx context.Context, obs *obsServer, scene, item string, visible bool) error
+		// setOpacity asettaa lähteen suodattimen opacity-arvon, 0 = läpinäkyvä ja 1 = peittävä
+		setOpacity(ctx context.Context, obs *obsServer, source, filter string, opacity float64) error
+		// sceneItems palauttaa scenen lähteiden nimet
+		sceneItems(ctx context.Context, obs *obsServer, scene string) ([]string, error)
+	}
+
+	// obsResponse on lukijagoroutinen pyynnön lähettäjälle välittämä vastaus
+	obsResponse struct {
+		id   string
+		data json.RawMessage
+		// OBS:n palauttama virheilmoitus, tyhjä jos pyyntö onnistui
+		error string
+	}
+
+	// obsRequestError on OBS:n pyyntöön palauttama virhe. Yhteys on tällöin edelleen kunnossa.
+	obsRequestError struct {
+		request string
+		message string
 	}
 
-	// OBS:lle lähetettävä komento
-	SetSceneItemProperties struct {
-		RequestType string `json:"request-type"`
-		MessageId   string `json:"message-id"`
-		Item        string `json:"item"`
-		Visible     bool   `json:"visible"`
-		SceneName   string `json:"scene-name"`
+	// cameraNaming muodostaa kameroiden (OBS-lähteiden) nimet pelaajien paikoista
+	cameraNaming struct {
+		template string
+		// Paikkakohtaiset nimet, avaimena joukkueen kirjain ja paikka, esim. "A1"
+		seats map[string]string
 	}
 
 	Player struct {
 		PlayerName string `json:"player_name"`
 		Camera     string `json:"camera"`
 		Place      int    `json:"place"`
+		Team       string `json:"-"`
 	}
 )
 
 var (
-	obsServers        []obsServer
-	Players           map[string]interface{}
-	Cameras           map[string]interface{}
-	previousPlayerSID string
-	messageID         int
-	testOnly          bool
+	switchMutex sync.Mutex
+	// dryRun korvaa kaikki videolähdöt virtuaalisilla sceneillä, ks. output_dryrun.go
+	dryRun bool
 )
 
 func ConfigureOBS(configuration Config) {
 	var err error
 
-	serverSetup()
+	if dryRun = *configuration.DryRun; dryRun {
+		log.Println("Kuivaharjoitus: videolähtöihin ei yhdistetä, virtuaalisten scenejen tila näkyy /state-rajapinnassa")
+	}
+	naming, err := loadCameraNaming(CQ)
+	if err != nil {
+		log.Fatalf("Kameroiden nimeämisasetusten lukeminen epäonnistui: %s", err)
+	}
+	if transition, err = loadTransition(CQ); err != nil {
+		log.Fatalf("Siirtymäasetusten lukeminen epäonnistui: %s", err)
+	}
+	settle, minHold, err := loadSwitching(CQ)
+	if err != nil {
+		log.Fatalf("Kameranvaihdon asetusten lukeminen epäonnistui: %s", err)
+	}
+	switcher.mu.Lock()
+	switcher.setDelays(settle, minHold)
+	switcher.mu.Unlock()
+
+	roster, err := loadRoster(*configuration.TeamAFile, *configuration.TeamBFile, naming)
+	if err != nil {
+		log.Fatal(err)
+	}
+	store.SetRoster(roster)
+	log.Printf("Pelaajia ladattu %d", roster.Len())
 
-	testOnly = *configuration.TestOnly
+	startOutputs()
+	preflight(*configuration.Strict)
+	log.Println("OBS konfiguraation lataus ja scenejen tarkistus tehty.")
+}
 
-	Players = make(map[string]interface{})
-	teamConfigurations := make(map[string]*jsonq.JsonQuery)
-	teamConfigurations["A"] = LoadJsonFile(*configuration.TeamAFile)
-	teamConfigurations["B"] = LoadJsonFile(*configuration.TeamBFile)
+// loadRoster lukee joukkuetiedostot ja yhdistää niiden pelaajat SteamID64-tunnuksilla
+func loadRoster(teamAFile, teamBFile string, naming cameraNaming) (*Roster, error) {
+	roster := NewRoster()
+	teamFiles := map[string]string{"A": teamAFile, "B": teamBFile}
 
 	log.Println("Load players:")
 	//yhdistetään eri tiedostot yhteen
-	for teamLetter, confJQ := range teamConfigurations {
-		var teamConf map[string]interface{}
-		teamConf, err = confJQ.Object("players")
-
+	for teamLetter, filename := range teamFiles {
+		confJQ, err := LoadJsonFile(filename)
 		if err != nil {
-			log.Fatalln("Joukkuekonfiguraation lukeminen ei onnistunut: ", err)
+			return nil, err
+		}
+		teamConf, err := confJQ.Object("players")
+		if err != nil {
+			return nil, fmt.Errorf("Joukkuekonfiguraation %s lukeminen ei onnistunut: %s", filename, err)
 		}
 
 		for confSteamId, iPlayerConf := range teamConf {
-			var steamId = UnifySteamId(confSteamId)
-			_ = VerifySteamId(steamId)
-
-			var playerConf = make(map[string]interface{})
-			playerConf = iPlayerConf.(map[string]interface{})
+			steamId, err := UnifySteamId(confSteamId)
+			if err != nil {
+				return nil, fmt.Errorf("Joukkuekonfiguraation %s SteamID on virheellinen: %s", filename, err)
+			}
+			_ = VerifySteamId(string(steamId))
+
+			playerConf, ok := iPlayerConf.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("Pelaajan %s tiedot tiedostossa %s eivät ole JSON-olio", confSteamId, filename)
+			}
 			var p Player
 
 			// Jos pelaajan place-arvoksi on annettu 0, ei tämän videokuvaa näytetä observauksen aikana.
-			// Jostain syystä JSONin sisällä oleva integer tulkitaankin juuri nyt floatiksi, minkä
-			// vuoksi tässä kohtaa joutuu tekemään ensin castauksen float64:ksi ja sitten vasta
-			// integeriksi.
-			p.Camera = teamLetter + strconv.Itoa(int(playerConf["place"].(float64)))
-			p.PlayerName = playerConf["player_name"].(string)
-			p.Place = int(playerConf["place"].(float64))
+			// JSONin luvut tulkitaan float64:ksi, minkä vuoksi paikka muutetaan erikseen integeriksi.
+			name, nameOk := playerConf["player_name"].(string)
+			place, placeOk := playerConf["place"].(float64)
+			if !nameOk || !placeOk {
+				return nil, fmt.Errorf("Pelaajalta %s puuttuu player_name tai place tiedostossa %s", confSteamId, filename)
+			}
+			p.PlayerName = name
+			p.Place = int(place)
+			p.Camera = naming.cameraName(teamLetter, p.Place)
+			p.Team = teamLetter
 			log.Printf("%s -> %s : %d - %s", steamId, p.PlayerName, p.Place, p.Camera)
-			Players[steamId] = p
+			if err = roster.Add(steamId, p); err != nil {
+				return nil, fmt.Errorf("Joukkuekonfiguraatio %s on virheellinen: %s", filename, err)
+			}
 		}
 	}
-
-	log.Printf("%v", Players)
-	log.Println("OBS konfiguraation lataus tehty ja palvelimiin yhdistetty.")
+	return roster, nil
 }
 
-// SwitchPlayer käskee tunnettuja palvelimia vaihtamaan inputtia, samat komennot jokaiselle.
-// Inputtien nimet pitää olla OBS:ssä uniikkeja jotta vain oikea kone reagoi (muut antavat virheen josta ei välitetä)
-
-func SwitchPlayer(currentPlayerSID string) {
-	if Players[currentPlayerSID] == nil {
+// switchPlayer käskee kameran omistavaa palvelinta vaihtamaan inputtia. Inputtien nimet pitää
+// olla OBS-palvelinten kesken uniikkeja, jotta kameran omistaja voidaan päätellä yksiselitteisesti.
+// Vaihtoja tekee vain vaihtogoroutine (cameraSwitcher.run) switchMutex:n suojaamana. Häivytyksessä
+// palautetaan sen loppuosa, joka ajetaan vapautetulla lukolla, ks. switchCameras.
+func switchPlayer(currentPlayerSID SteamID64, refresh bool) (finishFade func()) {
+	switchMutex.Lock()
+	defer switchMutex.Unlock()
+
+	roster := store.Roster()
+	previousPlayerSID := store.CurrentPlayer()
+	cp, ok := roster.BySteamID(currentPlayerSID)
+	if !ok {
 		log.Printf("Pelaajatunnusta %s ei löytynyt. Pelaajakuvan vaihto ei onnistu.", currentPlayerSID)
 		hideAllCameras()
-		previousPlayerSID = "0"
+		if previousPlayerSID != unknownPlayer {
+			store.SetCurrentPlayer(unknownPlayer)
+			publishOnAir()
+		}
 		return
 	}
-	cp := Players[currentPlayerSID].(Player)
+	pp, _ := roster.BySteamID(previousPlayerSID)
+
+	if refresh && currentPlayerSID == previousPlayerSID {
+		if store.CameraDisabled(cp.Camera) {
+			log.Println("Observoitavan pelaajan kamera poistettiin käytöstä, piilotetaan kaikki kamerakuvat")
+			hideAllCameras()
+		} else {
+			finishFade = switchCameras(cp.Camera, "")
+		}
+		publishOnAir()
+		return finishFade
+	}
 
-	var pp Player
-	if Players[previousPlayerSID] != nil {
-		pp = Players[previousPlayerSID].(Player)
+	if store.CameraDisabled(cp.Camera) {
+		if currentPlayerSID != previousPlayerSID {
+			log.Printf("Pelaajan %s kamera %s on poistettu käytöstä, piilotetaan kaikki kamerakuvat", cp.PlayerName, cp.Camera)
+			hideAllCameras()
+			store.SetCurrentPlayer(currentPlayerSID)
+			publishOnAir()
+		}
+		return
 	}
 
 	log.Println("Valittu pelaajakamera: ", cp.Camera)
@@ -122,96 +241,228 @@ func SwitchPlayer(currentPlayerSID string) {
 
 	if currentPlayerSID != previousPlayerSID {
 		log.Printf("Observattava pelaaja vaihtui %s -> %s", previousPlayerSID, currentPlayerSID)
-		// Uusi pelaaja näkyviin
-		setCameraVisibility(cp.Camera, true)
-		// Vanha pois. Jos uusi pelaaja on pienemmällä numerolla kuin vanha, näkyvä muutos tapahtuu vasta tässä
-		setCameraVisibility(pp.Camera, false)
-		previousPlayerSID = currentPlayerSID
+		finishFade = switchCameras(cp.Camera, pp.Camera)
+		store.SetCurrentPlayer(currentPlayerSID)
+		publishOnAir()
 	}
+	return finishFade
 }
 
-func serverSetup() {
-	servers, err := CQ.ArrayOfObjects("camera_servers")
-	if err != nil {
-		log.Fatal("OBS-palvelinten konfiguraatioiden luku epäonnistui: %s", err)
+// loadObsServer lukee camera_servers-merkinnän tai outputs-listan obs-tyyppisen merkinnän.
+// Palvelimeen ei vielä yhdistetä.
+func loadObsServer(v map[string]interface{}, routing outputRouting) (*obsServer, error) {
+	var err error
+	// Merkintää ei tulosteta sellaisenaan, koska siinä voi olla OBS:n salasana
+	address, _ := v["address"].(string)
+	port, _ := v["port"].(string)
+	if address == "" || port == "" {
+		return nil, fmt.Errorf("OBS-palvelimen %s:%s address ja port ovat pakollisia merkkijonoja", address, port)
 	}
-
-	obsServers = make([]obsServer, len(servers))
-	for i, v := range servers {
-		log.Printf("%d:%v", i, v)
-		obsServers[i].address = v["address"].(string)
-		obsServers[i].port = v["port"].(string)
-		if err = obsServers[i].Connect(); err != nil {
-			log.Fatal("OBS palvelimeen yhdistäminen epäonnistui: ", err)
+	obs := newObsServer(address, port)
+	obs.outputRouting = routing
+	if scene, ok := v["scene"].(string); ok {
+		obs.scene = scene
+	}
+	if password, ok := v["password"].(string); ok {
+		obs.password = password
+	}
+	// Kuivaharjoituksen palvelin korvataan virtuaalisella scenellä, ks. newOutput
+	if v["protocol"] != outputDryRun {
+		if obs.protocol, err = newObsProtocol(v["protocol"]); err != nil {
+			return nil, fmt.Errorf("OBS-palvelimen %s konfiguraatio on virheellinen: %s", obs.host(), err)
 		}
+		log.Printf("OBS-palvelin: %s (%s)", obs.host(), obs.protocol.name())
+	} else {
+		log.Printf("OBS-palvelin: %s (%s)", obs.host(), outputDryRun)
 	}
+	return obs, nil
 }
 
-func setCameraVisibility(camera string, visible bool) {
-	for _, s := range obsServers {
-		s.SetVisibility(camera, visible)
+func newObsServer(address, port string) *obsServer {
+	return &obsServer{
+		address:      address,
+		port:         port,
+		protocol:     &obsV4{},
+		scene:        defaultSceneName,
+		cameraErrors: make(map[string]string),
+		broken:       make(chan error, 1),
+		stop:         make(chan struct{}),
+		stopped:      make(chan struct{}),
 	}
 }
 
-func hideAllCameras() {
-	for _, p := range Players {
-		setCameraVisibility(p.(Player).Camera, false)
+// newObsProtocol valitsee camera_servers-merkinnän protocol-kentän mukaisen toteutuksen.
+// Jos kenttä puuttuu, käytetään vanhaa 4.x protokollaa.
+func newObsProtocol(protocol interface{}) (obsProtocol, error) {
+	if protocol == nil {
+		return &obsV4{}, nil
+	}
+	switch protocol {
+	case "v4", "4":
+		return &obsV4{}, nil
+	case "v5", "5":
+		return newObsV5(), nil
 	}
+	return nil, fmt.Errorf("tuntematon protokolla %v, sallitut arvot ovat \"v4\", \"v5\" ja \"dry-run\"", protocol)
 }
 
 func (obs *obsServer) Connect() error {
-	var err error
 	u := url.URL{Scheme: "ws", Host: obs.host(), Path: "/"}
-	obs.connection, _, err = websocket.DefaultDialer.Dial(u.String(), nil)
+	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
 	if err != nil {
 		return fmt.Errorf("Yhteys OBS-palvelimeen %s epäonnistui: %s", obs.host(), err)
 	}
-	log.Printf("Yhteys OBS-palvelimeen %s avattu", obs.host())
 
-	for i := 1; i <= 10; i++ {
-		obs.SetVisibility("cam"+strconv.Itoa(i), false)
+	conn.SetReadDeadline(time.Now().Add(obsRequestTimeout))
+	if err = obs.protocol.handshake(conn, obs.password); err != nil {
+		conn.Close()
+		return fmt.Errorf("Kättely OBS-palvelimen %s kanssa epäonnistui (%s): %s", obs.host(), obs.protocol.name(), err)
 	}
+	conn.SetReadDeadline(time.Time{})
 
-	log.Printf("Kamerakuvat piilotettu")
+	c := &obsConnection{
+		ws:       conn,
+		pending:  make(map[string]chan obsResponse),
+		outgoing: make(chan interface{}),
+		closed:   make(chan struct{}),
+	}
+
+	obs.mu.Lock()
+	// Edellisen yhteyden jo käsitelty katkos ei saa katkaista uutta yhteyttä
+	select {
+	case <-obs.broken:
+	default:
+	}
+	obs.connection = c
+	obs.mu.Unlock()
+
+	go obs.read(c)
+	go obs.write(c)
+	log.Printf("Yhteys OBS-palvelimeen %s avattu (%s)", obs.host(), obs.protocol.name())
 	return nil
 }
 
-func (obs obsServer) SetVisibility(camera string, visible bool) {
-	var (
-		err           error
-		commandToSend *SetSceneItemProperties
-		jsonToSend    []byte
-	)
+// loadCameraNaming lukee camera_naming-asetukset. Oletuksena kamerat nimetään joukkueen kirjaimen
+// ja paikan mukaan (A1..A5, B1..B5).
+func loadCameraNaming(cq *jsonq.JsonQuery) (cameraNaming, error) {
+	n := cameraNaming{template: defaultCameraTemplate, seats: make(map[string]string)}
+
+	if template, err := cq.String("camera_naming", "template"); err == nil {
+		n.template = template
+	}
+	if seats, err := cq.Object("camera_naming", "seats"); err == nil {
+		for seat, name := range seats {
+			camera, ok := name.(string)
+			if !ok {
+				return n, fmt.Errorf("paikan %s kameran nimi on virheellinen: %v", seat, name)
+			}
+			n.seats[seat] = camera
+		}
+	}
+	return n, nil
+}
+
+// cameraName palauttaa paikan kameran nimen. Paikkakohtainen nimi ohittaa nimimallin, jossa
+// {team} korvataan joukkueen kirjaimella, {place} paikalla ja {index} juoksevalla numerolla
+// 1..10 (B-joukkueen paikat 6..10). Paikalla 0 ei ole kameraa.
+func (n cameraNaming) cameraName(team string, place int) string {
+	if place == 0 {
+		return ""
+	}
+	if camera, ok := n.seats[team+strconv.Itoa(place)]; ok {
+		return camera
+	}
+
+	index := place
+	if team == "B" {
+		index += 5
+	}
+	return strings.NewReplacer(
+		"{team}", team,
+		"{place}", strconv.Itoa(place),
+		"{index}", strconv.Itoa(index),
+	).Replace(n.template)
+}
+
+// obsAuthResponse laskee obs-websocketin challenge/salt -autentikaation vastauksen, joka on
+// molemmissa protokollaversioissa sama: base64(sha256(base64(sha256(salasana + salt)) + challenge))
+func obsAuthResponse(password, salt, challenge string) string {
+	secret := sha256.Sum256([]byte(password + salt))
+	auth := sha256.Sum256([]byte(base64.StdEncoding.EncodeToString(secret[:]) + challenge))
+	return base64.StdEncoding.EncodeToString(auth[:])
+}
 
-	messageID++
-	commandToSend = &SetSceneItemProperties{
-		RequestType: "SetSceneItemProperties",
-		MessageId:   strconv.Itoa(messageID),
-		Item:        camera, // cam1..cam10
-		Visible:     visible,
-		SceneName:   "Scene1"}
+func (obs *obsServer) SetVisibility(camera string, visible bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), obsRequestTimeout)
+	defer cancel()
+	err := obs.protocol.setVisibility(ctx, obs, obs.scene, camera, visible)
 
-	jsonToSend, err = json.Marshal(commandToSend)
+	obs.mu.Lock()
 	if err != nil {
-		log.Fatalf("Lähetettävän JSON-viestin muodostaminen epäonnistui: %s", err)
-		return
+		obs.cameraErrors[camera] = err.Error()
+	} else {
+		delete(obs.cameraErrors, camera)
 	}
+	obs.mu.Unlock()
 
-	//debug ilman servereitä
-	if testOnly {
-		log.Println("Testimoodi, viestiä ei lähetetä OBS-palvelimelle")
-		//log.Println(jsonToSend)
-		//log.Println(obsServers.connection)
-		return
+	if err != nil {
+		log.Printf("Kameran %s näkyvyyden muutos OBS-palvelimella %s epäonnistui: %s", camera, obs.host(), err)
 	}
+}
 
-	err = obs.connection.WriteMessage(websocket.TextMessage, jsonToSend)
+func (obs *obsServer) SetOpacity(camera string, opacity float64) {
+	ctx, cancel := context.WithTimeout(context.Background(), obsRequestTimeout)
+	defer cancel()
+	err := obs.protocol.setOpacity(ctx, obs, camera, transition.filter, opacity)
+
+	obs.mu.Lock()
 	if err != nil {
-		log.Printf("Websocket kirjoitus OBS-palvelimelle %s epäonnistui: %s", obs.host(), err)
+		obs.cameraErrors[camera] = err.Error()
+	} else {
+		delete(obs.cameraErrors, camera)
 	}
-	return
+	obs.mu.Unlock()
+
+	if err != nil {
+		log.Printf("Kameran %s läpinäkyvyyden muutos OBS-palvelimella %s epäonnistui: %s", camera, obs.host(), err)
+	}
+}
+
+func (e *obsRequestError) Error() string {
+	return fmt.Sprintf("%s epäonnistui: %s", e.request, e.message)
 }
 
-func (obs obsServer) host() string {
+func (obs *obsServer) host() string {
 	return obs.address + ":" + obs.port
 }
+
+func (obs *obsServer) name() string {
+	return obs.host()
+}
+
+func (obs *obsServer) ShowCamera(camera string) {
+	obs.SetVisibility(camera, true)
+}
+
+func (obs *obsServer) HideCamera(camera string) {
+	obs.SetVisibility(camera, false)
+}
+
+// HideAll piilottaa palvelimen kamerat. Kutsujalla on switchMutex.
+func (obs *obsServer) HideAll() {
+	for _, camera := range ownedCameras(obs) {
+		obs.SetVisibility(camera, false)
+	}
+}
+
+// start käynnistää yhteyden valvonnan, joka yhdistää palvelimeen taustalla
+func (obs *obsServer) start() {
+	go obs.supervise()
+}
+
+// listCameras palauttaa scenen lähteet
+func (obs *obsServer) listCameras() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), obsRequestTimeout)
+	defer cancel()
+	return obs.protocol.sceneItems(ctx, obs, obs.scene)
+}
@@ -0,0 +1,282 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	obsReconnectMinDelay = time.Second
+	obsReconnectMaxDelay = 30 * time.Second
+	obsPingInterval      = 5 * time.Second
+	obsWriteTimeout      = 2 * time.Second
+	obsRequestTimeout    = 2 * time.Second
+)
+
+var (
+	errObsNotConnected   = errors.New("ei yhteyttä OBS-palvelimeen")
+	errObsConnectionLost = errors.New("yhteys OBS-palvelimeen katkesi ennen vastausta")
+	errObsStopped        = errors.New("yhteys OBS-palvelimeen suljettiin")
+)
+
+type (
+	// obsConnection on yksi avattu websocket-yhteys. Yhteyteen kirjoittaa vain sen
+	// kirjoittajagoroutine ja siitä lukee vain sen lukijagoroutine.
+	obsConnection struct {
+		ws *websocket.Conn
+		// Vastausta odottavat pyynnöt, suojattu obs.mu:lla
+		pending  map[string]chan obsResponse
+		outgoing chan interface{}
+		// closed suljetaan kun valvontagoroutine on todennut yhteyden katkenneeksi
+		closed chan struct{}
+	}
+)
+
+// supervise pitää yhteyden OBS-palvelimeen auki. Katkenneen yhteyden jälkeen yhdistetään
+// uudelleen kasvavalla viiveellä ja onnistuneen yhdistämisen jälkeen palvelimelle palautetaan
+// valittuna olevan kameran tila. Valvonta päättyy vasta Stop-kutsuun.
+func (obs *obsServer) supervise() {
+	defer close(obs.stopped)
+
+	delay := obsReconnectMinDelay
+	for {
+		obs.setHealth(outputConnecting, nil)
+		if err := obs.Connect(); err != nil {
+			obs.setHealth(outputDown, err)
+			log.Printf("%s, yritetään uudelleen %s kuluttua", err, delay)
+			select {
+			case <-time.After(delay):
+			case <-obs.stop:
+				return
+			}
+			if delay *= 2; delay > obsReconnectMaxDelay {
+				delay = obsReconnectMaxDelay
+			}
+			continue
+		}
+		delay = obsReconnectMinDelay
+
+		obs.setHealth(outputUp, nil)
+		obs.restore()
+
+		err := obs.waitForDisconnect()
+		obs.setHealth(outputDown, err)
+
+		obs.mu.Lock()
+		close(obs.connection.closed)
+		obs.connection.ws.Close()
+		obs.connection = nil
+		if err != errObsStopped {
+			obs.health.Reconnects++
+		}
+		obs.mu.Unlock()
+
+		if err == errObsStopped {
+			log.Printf("Yhteys OBS-palvelimeen %s suljettu", obs.host())
+			return
+		}
+		log.Printf("Yhteys OBS-palvelimeen %s katkesi: %s", obs.host(), err)
+	}
+}
+
+// Stop sulkee yhteyden OBS-palvelimeen ja lopettaa uudelleenyhdistämisen. Stop palaa kun
+// valvontagoroutine on päättynyt, joten sitä saa kutsua vain kerran ja vain käynnistetylle palvelimelle.
+func (obs *obsServer) Stop() {
+	close(obs.stop)
+	<-obs.stopped
+}
+
+// waitForDisconnect palaa kun lukija- tai kirjoittajagoroutine toteaa yhteyden katkenneen
+// tai yhteys suljetaan Stop-kutsulla
+func (obs *obsServer) waitForDisconnect() error {
+	select {
+	case err := <-obs.broken:
+		return err
+	case <-obs.stop:
+		return errObsStopped
+	}
+}
+
+// restore hakee tarvittaessa kamerat OBS:n scenestä, palauttaa palvelimelle valittuna olevan
+// kameran ja piilottaa sen muut kamerat
+func (obs *obsServer) restore() {
+	if obs.discover {
+		obs.discoverCameras()
+	}
+	restoreCameras(obs)
+}
+
+// Request lähettää pyynnön OBS:lle ja odottaa siihen vastausta, kunnes ctx päättyy. OBS:n
+// palauttama virhe palautetaan *obsRequestError-tyyppisenä.
+func (obs *obsServer) Request(ctx context.Context, requestType string, data map[string]interface{}) (json.RawMessage, error) {
+	resp, err := obs.request(ctx, requestType, data)
+	if err != nil {
+		obs.mu.Lock()
+		obs.requestsFailed++
+		obs.mu.Unlock()
+	}
+	return resp, err
+}
+
+func (obs *obsServer) request(ctx context.Context, requestType string, data map[string]interface{}) (json.RawMessage, error) {
+	obs.mu.Lock()
+	c := obs.connection
+	if c == nil {
+		obs.mu.Unlock()
+		return nil, errObsNotConnected
+	}
+	obs.nextID++
+	id := strconv.Itoa(obs.nextID)
+	reply := make(chan obsResponse, 1)
+	c.pending[id] = reply
+	obs.mu.Unlock()
+
+	forget := func() {
+		obs.mu.Lock()
+		delete(c.pending, id)
+		obs.mu.Unlock()
+	}
+
+	select {
+	case c.outgoing <- obs.protocol.encodeRequest(id, requestType, data):
+		obs.mu.Lock()
+		obs.requestsSent++
+		obs.mu.Unlock()
+	case <-c.closed:
+		forget()
+		return nil, errObsConnectionLost
+	case <-ctx.Done():
+		forget()
+		return nil, fmt.Errorf("%s: pyyntöä ei saatu lähetettyä OBS-palvelimelle %s: %s", requestType, obs.host(), ctx.Err())
+	}
+
+	select {
+	case resp, ok := <-reply:
+		if !ok {
+			return nil, errObsConnectionLost
+		}
+		if resp.error != "" {
+			return nil, &obsRequestError{requestType, resp.error}
+		}
+		return resp.data, nil
+	case <-ctx.Done():
+		forget()
+		return nil, fmt.Errorf("%s: ei vastausta OBS-palvelimelta %s: %s", requestType, obs.host(), ctx.Err())
+	}
+}
+
+// write on yhteyskohtainen kirjoittajagoroutine. Kaikki pyynnöt ja ping-viestit kulkevat sen
+// kautta, joten yhteyteen ei koskaan kirjoiteta kahdesta goroutinesta yhtä aikaa.
+func (obs *obsServer) write(c *obsConnection) {
+	ticker := time.NewTicker(obsPingInterval)
+	defer ticker.Stop()
+
+	for {
+		var err error
+		select {
+		case msg := <-c.outgoing:
+			c.ws.SetWriteDeadline(time.Now().Add(obsWriteTimeout))
+			err = c.ws.WriteJSON(msg)
+		case <-ticker.C:
+			c.ws.SetWriteDeadline(time.Now().Add(obsWriteTimeout))
+			err = c.ws.WriteMessage(websocket.PingMessage, nil)
+		case <-c.closed:
+			return
+		}
+		if err != nil {
+			obs.markBroken(c, err)
+			return
+		}
+	}
+}
+
+// read on yhteyskohtainen lukijagoroutine, joka välittää vastaukset niitä odottaville
+// pyynnöille. Lukuvirhe katkaisee yhteyden ja vapauttaa kaikki odottavat pyynnöt.
+func (obs *obsServer) read(c *obsConnection) {
+	for {
+		_, raw, err := c.ws.ReadMessage()
+		if err != nil {
+			obs.mu.Lock()
+			for id, reply := range c.pending {
+				close(reply)
+				delete(c.pending, id)
+			}
+			obs.mu.Unlock()
+			obs.markBroken(c, err)
+			return
+		}
+
+		resp, ok := obs.protocol.decodeResponse(raw)
+		if !ok {
+			continue
+		}
+		obs.mu.Lock()
+		reply := c.pending[resp.id]
+		delete(c.pending, resp.id)
+		obs.mu.Unlock()
+
+		if reply == nil {
+			log.Printf("OBS-palvelin %s vastasi pyyntöön %s, jota ei enää odotettu", obs.host(), resp.id)
+			continue
+		}
+		reply <- resp
+	}
+}
+
+// markBroken ilmoittaa valvontagoroutinelle yhteyden katkeamisesta, jos yhteys on yhä käytössä
+func (obs *obsServer) markBroken(c *obsConnection, err error) {
+	obs.mu.Lock()
+	defer obs.mu.Unlock()
+
+	if obs.connection != c {
+		return
+	}
+	obs.health.LastError = err.Error()
+	select {
+	case obs.broken <- err:
+	default:
+	}
+}
+
+func (obs *obsServer) setHealth(state string, err error) {
+	obs.mu.Lock()
+	changed := obs.health.State != state
+	if changed {
+		obs.health.Since = time.Now()
+	}
+	obs.health.State = state
+	if err != nil {
+		obs.health.LastError = err.Error()
+	}
+	obs.mu.Unlock()
+
+	if changed {
+		hub.publish(eventObsServer, obs.Health())
+	}
+}
+
+func (obs *obsServer) Health() outputStatus {
+	obs.mu.Lock()
+	defer obs.mu.Unlock()
+
+	cameraErrors := make(map[string]string, len(obs.cameraErrors))
+	for camera, err := range obs.cameraErrors {
+		cameraErrors[camera] = err
+	}
+	return outputStatus{
+		Address:        obs.host(),
+		Kind:           outputOBS,
+		Protocol:       obs.protocol.name(),
+		outputHealth:   obs.health,
+		CameraErrors:   cameraErrors,
+		RequestsSent:   obs.requestsSent,
+		RequestsFailed: obs.requestsFailed,
+	}
+}
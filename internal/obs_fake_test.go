@@ -0,0 +1,398 @@
+package internal
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeOBS on testien obs-websocket -palvelin. Se puhuu 4.x tai 5.x protokollaa, pitää kirjaa
+// yhden scenen lähteiden näkyvyydestä ja osaa tuottaa virheitä, viiveitä ja katkoksia.
+type fakeOBS struct {
+	protocol string
+	scene    string
+	server   *httptest.Server
+	upgrader websocket.Upgrader
+
+	mu      sync.Mutex
+	sources []string
+	visible map[string]bool
+	// idBase siirtää 5.x sceneItemId:itä, jotta OBS:n uudelleenkäynnistyksen voi simuloida
+	idBase   int
+	failures map[string]string
+	delay    time.Duration
+	refuse   bool
+	conns    map[*websocket.Conn]bool
+	connects int
+	requests []string
+	// password vaatii autentikaation, tyhjä arvo ohittaa sen kuten OBS ilman salasanaa
+	password string
+}
+
+// fakeOBS:n autentikaatiossa käyttämät kiinteät salt ja challenge
+const (
+	fakeOBSSalt      = "lM1GncleQOaCu9lT1yeUZhFYnqhsLLP1G5lAGo3ixaI="
+	fakeOBSChallenge = "+IxH4CnCiqpX1rM9scsNynZzbOe4KhDeYcTNS3PDaeY="
+)
+
+// newFakeOBS käynnistää palvelimen, jonka scenessä ovat annetut lähteet piilotettuina. Kutsuja
+// sulkee palvelimen close-kutsulla.
+func newFakeOBS(protocol string, sources ...string) *fakeOBS {
+	f := &fakeOBS{
+		protocol: protocol,
+		scene:    defaultSceneName,
+		sources:  sources,
+		visible:  make(map[string]bool),
+		idBase:   1,
+		failures: make(map[string]string),
+		conns:    make(map[*websocket.Conn]bool),
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+// obsServer palauttaa PKM:n palvelinmäärittelyn, joka osoittaa tähän palvelimeen
+func (f *fakeOBS) obsServer(t *testing.T) *obsServer {
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(f.server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	obs := newObsServer(host, port)
+	if obs.protocol, err = newObsProtocol(f.protocol); err != nil {
+		t.Fatal(err)
+	}
+	return obs
+}
+
+func (f *fakeOBS) close() {
+	f.disconnect()
+	f.server.Close()
+}
+
+// visibleSources palauttaa näkyvissä olevat lähteet aakkosjärjestyksessä
+func (f *fakeOBS) visibleSources() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	visible := []string{}
+	for _, source := range f.sources {
+		if f.visible[source] {
+			visible = append(visible, source)
+		}
+	}
+	sort.Strings(visible)
+	return visible
+}
+
+func (f *fakeOBS) setVisible(source string, visible bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.visible[source] = visible
+}
+
+// fail saa requestType-tyyppiset pyynnöt epäonnistumaan annetulla viestillä, tyhjä viesti poistaa virheen
+func (f *fakeOBS) fail(requestType, message string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if message == "" {
+		delete(f.failures, requestType)
+	} else {
+		f.failures[requestType] = message
+	}
+}
+
+// setDelay viivästää jokaisen vastauksen
+func (f *fakeOBS) setDelay(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.delay = d
+}
+
+// setPassword ottaa autentikaation käyttöön uusille yhteyksille
+func (f *fakeOBS) setPassword(password string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.password = password
+}
+
+// authenticated tarkistaa asiakkaan autentikaatiovastauksen
+func (f *fakeOBS) authenticated(auth string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.password == "" || auth == obsAuthResponse(f.password, fakeOBSSalt, fakeOBSChallenge)
+}
+
+// setRefuse hylkää uudet yhteydet kuten sammunut OBS
+func (f *fakeOBS) setRefuse(refuse bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.refuse = refuse
+}
+
+// disconnect katkaisee avoimet yhteydet
+func (f *fakeOBS) disconnect() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for conn := range f.conns {
+		conn.Close()
+	}
+}
+
+// restart katkaisee yhteydet ja palauttaa scenen OBS:n käynnistystilaan: kaikki lähteet näkyvissä
+// ja uudet sceneItemId:t
+func (f *fakeOBS) restart() {
+	f.disconnect()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, source := range f.sources {
+		f.visible[source] = true
+	}
+	f.idBase += 100
+}
+
+func (f *fakeOBS) connectCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.connects
+}
+
+// requestCount palauttaa vastaanotettujen requestType-tyyppisten pyyntöjen määrän
+func (f *fakeOBS) requestCount(requestType string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, r := range f.requests {
+		if r == requestType {
+			n++
+		}
+	}
+	return n
+}
+
+func (f *fakeOBS) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	refuse := f.refuse
+	f.mu.Unlock()
+	if refuse {
+		http.Error(w, "OBS ei ole käynnissä", http.StatusServiceUnavailable)
+		return
+	}
+
+	conn, err := f.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	f.mu.Lock()
+	f.conns[conn] = true
+	f.connects++
+	f.mu.Unlock()
+	defer func() {
+		f.mu.Lock()
+		delete(f.conns, conn)
+		f.mu.Unlock()
+		conn.Close()
+	}()
+
+	if f.protocol == "v5" {
+		f.serveV5(conn)
+	} else {
+		f.serveV4(conn)
+	}
+}
+
+func (f *fakeOBS) serveV4(conn *websocket.Conn) {
+	authenticated := f.authenticated("")
+	for {
+		var msg map[string]interface{}
+		if err := conn.ReadJSON(&msg); err != nil {
+			return
+		}
+		requestType, _ := msg["request-type"].(string)
+		id, _ := msg["message-id"].(string)
+
+		var (
+			data       map[string]interface{}
+			errMessage string
+		)
+		switch {
+		case requestType == "GetAuthRequired" && !authenticated:
+			data = map[string]interface{}{"authRequired": true, "salt": fakeOBSSalt, "challenge": fakeOBSChallenge}
+		case requestType == "Authenticate":
+			auth, _ := msg["auth"].(string)
+			if authenticated = f.authenticated(auth); !authenticated {
+				errMessage = "Authentication Failed."
+			}
+		case !authenticated:
+			errMessage = "Not Authenticated"
+		default:
+			data, errMessage = f.handle(requestType, msg)
+		}
+		resp := map[string]interface{}{"message-id": id, "status": "ok"}
+		if errMessage != "" {
+			resp["status"] = "error"
+			resp["error"] = errMessage
+		}
+		for k, v := range data {
+			resp[k] = v
+		}
+		if err := conn.WriteJSON(resp); err != nil {
+			return
+		}
+	}
+}
+
+func (f *fakeOBS) serveV5(conn *websocket.Conn) {
+	hello := map[string]interface{}{
+		"obsWebSocketVersion": "5.0.0",
+		"rpcVersion":          obsV5RPCVersion,
+	}
+	if !f.authenticated("") {
+		hello["authentication"] = map[string]string{"salt": fakeOBSSalt, "challenge": fakeOBSChallenge}
+	}
+	if err := conn.WriteJSON(obsV5Message{Op: obsV5OpHello, D: mustMarshal(hello)}); err != nil {
+		return
+	}
+	var identify obsV5Identify
+	if err := obsV5Read(conn, obsV5OpIdentify, &identify); err != nil {
+		return
+	}
+	if !f.authenticated(identify.Authentication) {
+		// OBS sulkee yhteyden koodilla 4009 (AuthenticationFailed)
+		msg := websocket.FormatCloseMessage(4009, "Authentication failed.")
+		conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		return
+	}
+	identified := obsV5Message{Op: obsV5OpIdentified, D: mustMarshal(map[string]interface{}{
+		"negotiatedRpcVersion": obsV5RPCVersion,
+	})}
+	if err := conn.WriteJSON(identified); err != nil {
+		return
+	}
+
+	for {
+		var msg obsV5Message
+		if err := conn.ReadJSON(&msg); err != nil {
+			return
+		}
+		if msg.Op != obsV5OpRequest {
+			continue
+		}
+		var req struct {
+			RequestType string                 `json:"requestType"`
+			RequestId   string                 `json:"requestId"`
+			RequestData map[string]interface{} `json:"requestData"`
+		}
+		if err := json.Unmarshal(msg.D, &req); err != nil {
+			return
+		}
+
+		data, errMessage := f.handle(req.RequestType, req.RequestData)
+		status := map[string]interface{}{"result": true, "code": 100}
+		if errMessage != "" {
+			status = map[string]interface{}{"result": false, "code": 600, "comment": errMessage}
+		}
+		resp := obsV5Message{Op: obsV5OpRequestResponse, D: mustMarshal(map[string]interface{}{
+			"requestType":   req.RequestType,
+			"requestId":     req.RequestId,
+			"requestStatus": status,
+			"responseData":  data,
+		})}
+		if err := conn.WriteJSON(resp); err != nil {
+			return
+		}
+	}
+}
+
+// handle käsittelee pyynnön ja palauttaa vastauksen kentät tai virheilmoituksen
+func (f *fakeOBS) handle(requestType string, data map[string]interface{}) (map[string]interface{}, string) {
+	f.mu.Lock()
+	delay := f.delay
+	f.mu.Unlock()
+	time.Sleep(delay)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, requestType)
+	if message, ok := f.failures[requestType]; ok {
+		return nil, message
+	}
+
+	switch requestType {
+	case "GetAuthRequired":
+		return map[string]interface{}{"authRequired": false}, ""
+
+	case "GetSceneList":
+		sources := make([]map[string]interface{}, len(f.sources))
+		for i, source := range f.sources {
+			sources[i] = map[string]interface{}{"name": source, "render": f.visible[source]}
+		}
+		return map[string]interface{}{
+			"current-scene": f.scene,
+			"scenes":        []map[string]interface{}{{"name": f.scene, "sources": sources}},
+		}, ""
+
+	case "SetSceneItemProperties":
+		if data["scene-name"] != f.scene {
+			return nil, "requested scene does not exist"
+		}
+		item, _ := data["item"].(string)
+		visible, ok := data["visible"].(bool)
+		if !f.hasSource(item) || !ok {
+			return nil, "specified scene item doesn't exist"
+		}
+		f.visible[item] = visible
+		return nil, ""
+
+	case "GetSceneItemList":
+		if data["sceneName"] != f.scene {
+			return nil, "No source was found by the name of " + f.scene
+		}
+		items := make([]map[string]interface{}, len(f.sources))
+		for i, source := range f.sources {
+			items[i] = map[string]interface{}{"sourceName": source, "sceneItemId": f.idBase + i, "sceneItemEnabled": f.visible[source]}
+		}
+		return map[string]interface{}{"sceneItems": items}, ""
+
+	case "GetSceneItemId":
+		source, _ := data["sourceName"].(string)
+		if data["sceneName"] != f.scene || !f.hasSource(source) {
+			return nil, "No scene items were found in the specified scene by that name"
+		}
+		for i, s := range f.sources {
+			if s == source {
+				return map[string]interface{}{"sceneItemId": f.idBase + i}, ""
+			}
+		}
+
+	case "SetSceneItemEnabled":
+		id, _ := data["sceneItemId"].(float64)
+		enabled, ok := data["sceneItemEnabled"].(bool)
+		i := int(id) - f.idBase
+		if data["sceneName"] != f.scene || i < 0 || i >= len(f.sources) || !ok {
+			return nil, "No scene item was found in the specified scene by that ID"
+		}
+		f.visible[f.sources[i]] = enabled
+		return nil, ""
+
+	case "SetSourceFilterSettings":
+		return nil, ""
+	}
+	return nil, "unknown request type " + requestType
+}
+
+func (f *fakeOBS) hasSource(source string) bool {
+	for _, s := range f.sources {
+		if s == source {
+			return true
+		}
+	}
+	return false
+}
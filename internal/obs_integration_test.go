@@ -0,0 +1,445 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeOBSTimeout on aika, jonka kuluessa valepalvelimen tilan pitää asettua odotetuksi
+const fakeOBSTimeout = 5 * time.Second
+
+// startIntegration alustaa PKM:n tilan testirosterilla, käynnistää annetut videolähdöt ja
+// palauttaa PKM:n HTTP-rajapinnan sekä funktion, joka pysäyttää rajapinnan ja lähdöt
+func startIntegration(t *testing.T, outs ...videoOutput) (*httptest.Server, func()) {
+	store = newStateStore()
+	store.SetRoster(testRoster(t))
+	switcher = &cameraSwitcher{override: overrideAuto}
+	transition = transitionConfig{mode: transitionCut}
+	outputs = outs
+	if err := assignCameraOwners(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, o := range outs {
+		o.start()
+	}
+	stopOutputs := func() {
+		for _, o := range outs {
+			o.Stop()
+		}
+		outputs = nil
+		cameraOwners = make(map[string]videoOutput)
+	}
+	for _, o := range outs {
+		if !waitUntilUp(o, fakeOBSTimeout) {
+			stopOutputs()
+			t.Fatalf("videolähtö %s ei tullut käyttöön", o.name())
+		}
+	}
+
+	server := httptest.NewServer(newRouter())
+	return server, func() {
+		server.Close()
+		stopOutputs()
+	}
+}
+
+// observe lähettää GSI-paketin, jossa observer katsoo pelaajaa sid
+func observe(t *testing.T, server *httptest.Server, sid string) {
+	t.Helper()
+	resp, err := http.Post(server.URL+"/", "application/json", strings.NewReader(gsiPacket(sid, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GSI-paketin vastaus %d, odotettiin 200", resp.StatusCode)
+	}
+	waitSwitched(t)
+}
+
+// expectVisible odottaa, että valepalvelimella näkyvät täsmälleen annetut lähteet
+func expectVisible(t *testing.T, f *fakeOBS, want ...string) {
+	t.Helper()
+	if want == nil {
+		want = []string{}
+	}
+	deadline := time.Now().Add(fakeOBSTimeout)
+	for {
+		got := f.visibleSources()
+		if reflect.DeepEqual(got, want) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("valepalvelimella (%s) näkyvissä %v, odotettiin %v", f.protocol, got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitFor odottaa ehdon täyttymistä
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(fakeOBSTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s ei toteutunut", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// newTeamFakes käynnistää A-joukkueen kameroille 4.x ja B-joukkueen kameroille 5.x valepalvelimen.
+// Kaikki lähteet ovat aluksi näkyvissä kuten juuri käynnistetyssä OBS:ssä.
+func newTeamFakes(t *testing.T) (a, b *fakeOBS, sa, sb *obsServer) {
+	a = newFakeOBS("v4", "A1", "A2", "A3", "A4", "A5", "Tulostaulu")
+	b = newFakeOBS("v5", "B1", "B2", "B3", "B4", "B5")
+	for _, f := range []*fakeOBS{a, b} {
+		for _, source := range f.sources {
+			f.setVisible(source, true)
+		}
+	}
+	sa, sb = a.obsServer(t), b.obsServer(t)
+	sa.teams = []string{"A"}
+	sb.teams = []string{"B"}
+	return a, b, sa, sb
+}
+
+func TestOBSIntegrationSwitching(t *testing.T) {
+	a, b, sa, sb := newTeamFakes(t)
+	defer a.close()
+	defer b.close()
+	server, stop := startIntegration(t, sa, sb)
+	defer stop()
+
+	// Yhdistettäessä kamerat piilotetaan, muihin lähteisiin ei kosketa
+	expectVisible(t, a, "Tulostaulu")
+	expectVisible(t, b)
+
+	observe(t, server, "76561198293547781")
+	expectVisible(t, a, "A1", "Tulostaulu")
+	expectVisible(t, b)
+
+	observe(t, server, "76561198293547773")
+	expectVisible(t, a, "Tulostaulu")
+	expectVisible(t, b, "B3")
+
+	observe(t, server, "76561198293547775")
+	expectVisible(t, a, "Tulostaulu")
+	expectVisible(t, b, "B5")
+
+	observe(t, server, "76561198293547784")
+	expectVisible(t, a, "A4", "Tulostaulu")
+	expectVisible(t, b)
+
+	// Tuntematon pelaaja piilottaa kaikki kamerat
+	observe(t, server, "76561190000000000")
+	expectVisible(t, a, "Tulostaulu")
+	expectVisible(t, b)
+
+	for _, s := range []*obsServer{sa, sb} {
+		if errs := s.Health().CameraErrors; len(errs) > 0 {
+			t.Errorf("palvelimella %s kameravirheitä: %v", s.host(), errs)
+		}
+	}
+	// 5.x sceneItemId:t haetaan vain kerran per lähde
+	if n := b.requestCount("GetSceneItemId"); n != 5 {
+		t.Errorf("GetSceneItemId-pyyntöjä %d, odotettiin 5", n)
+	}
+}
+
+func TestOBSIntegrationRequestErrors(t *testing.T) {
+	for _, tc := range []struct {
+		protocol, request string
+	}{
+		{"v4", "SetSceneItemProperties"},
+		{"v5", "SetSceneItemEnabled"},
+	} {
+		t.Run(tc.protocol, func(t *testing.T) {
+			f := newFakeOBS(tc.protocol, "A1", "A2", "A3", "A4", "A5", "B1", "B2", "B3", "B4", "B5")
+			defer f.close()
+			s := f.obsServer(t)
+			s.teams = []string{"A", "B"}
+			server, stop := startIntegration(t, s)
+			defer stop()
+			expectVisible(t, f)
+
+			f.fail(tc.request, "lähde lukittu")
+			observe(t, server, "76561198293547782")
+			expectVisible(t, f)
+			if err := s.Health().CameraErrors["A2"]; !strings.Contains(err, "lähde lukittu") {
+				t.Errorf("kameran A2 virhe %q, odotettiin OBS:n virheilmoitusta", err)
+			}
+
+			// Virhe ei katkaise yhteyttä, ja seuraava onnistunut komento poistaa kameran virheen.
+			// Ensimmäisen vaihdon yhteydessä piilotetuille muille kameroille virhe jää voimaan.
+			f.fail(tc.request, "")
+			observe(t, server, "76561198293547773")
+			expectVisible(t, f, "B3")
+			observe(t, server, "76561198293547782")
+			expectVisible(t, f, "A2")
+			errs := s.Health().CameraErrors
+			if err, ok := errs["A2"]; ok {
+				t.Errorf("kameran A2 virhe jäi voimaan: %s", err)
+			}
+			if _, ok := errs["A1"]; !ok {
+				t.Errorf("kameran A1 piilotuksen virhettä ei kirjattu")
+			}
+			if state := s.Health().State; state != outputUp {
+				t.Errorf("yhteyden tila %s, odotettiin %s", state, outputUp)
+			}
+		})
+	}
+}
+
+// TestOBSIntegrationDelay tarkistaa, että hidas vastaus odotetaan ja liian hidas kirjataan
+// kameravirheeksi katkaisematta yhteyttä
+func TestOBSIntegrationDelay(t *testing.T) {
+	a, b, sa, sb := newTeamFakes(t)
+	defer a.close()
+	defer b.close()
+	server, stop := startIntegration(t, sa, sb)
+	defer stop()
+	expectVisible(t, b)
+
+	b.setDelay(200 * time.Millisecond)
+	observe(t, server, "76561198293547771")
+	expectVisible(t, b, "B1")
+
+	b.setDelay(obsRequestTimeout + 200*time.Millisecond)
+	observe(t, server, "76561198293547784")
+	expectVisible(t, a, "A4", "Tulostaulu")
+	if err := sb.Health().CameraErrors["B1"]; !strings.Contains(err, "ei vastausta") {
+		t.Errorf("kameran B1 virhe %q, odotettiin aikakatkaisua", err)
+	}
+
+	// Myöhästynyt vastaus ohitetaan ja yhteys jatkaa toimintaansa
+	b.setDelay(0)
+	expectVisible(t, b)
+	observe(t, server, "76561198293547772")
+	expectVisible(t, a, "Tulostaulu")
+	expectVisible(t, b, "B2")
+	if state := sb.Health().State; state != outputUp {
+		t.Errorf("yhteyden tila %s, odotettiin %s", state, outputUp)
+	}
+}
+
+// TestOBSIntegrationReconnect käynnistää B-joukkueen OBS:n uudelleen kesken ottelun. Katkoksen
+// jälkeen palvelimen scenen pitää vastata lähetyksen tilaa, vaikka OBS:n sceneItemId:t muuttuivat.
+func TestOBSIntegrationReconnect(t *testing.T) {
+	a, b, sa, sb := newTeamFakes(t)
+	defer a.close()
+	defer b.close()
+	server, stop := startIntegration(t, sa, sb)
+	defer stop()
+
+	observe(t, server, "76561198293547774")
+	expectVisible(t, b, "B4")
+
+	b.setRefuse(true)
+	b.restart()
+	waitFor(t, "B-palvelimen yhteyden katkeaminen", func() bool { return sb.Health().State != outputUp })
+
+	// Katkoksen aikana observer siirtyy A-joukkueeseen, B4:n piilotus ei mene perille
+	observe(t, server, "76561198293547783")
+	expectVisible(t, a, "A3", "Tulostaulu")
+	expectVisible(t, b, "B1", "B2", "B3", "B4", "B5")
+
+	b.setRefuse(false)
+	if !waitUntilUp(sb, fakeOBSTimeout) {
+		t.Fatal("yhteys B-palvelimeen ei palautunut")
+	}
+	expectVisible(t, b)
+	expectVisible(t, a, "A3", "Tulostaulu")
+
+	observe(t, server, "76561198293547775")
+	expectVisible(t, a, "Tulostaulu")
+	expectVisible(t, b, "B5")
+
+	if n := sb.Health().Reconnects; n != 1 {
+		t.Errorf("uudelleenyhdistämisiä %d, odotettiin 1", n)
+	}
+	if n := b.connectCount(); n != 2 {
+		t.Errorf("yhteyksiä B-palvelimeen %d, odotettiin 2", n)
+	}
+}
+
+// TestOBSIntegrationDiscovery hakee kameroiden omistajat molempien protokollien scenelistoista
+func TestOBSIntegrationDiscovery(t *testing.T) {
+	a, b, sa, sb := newTeamFakes(t)
+	defer a.close()
+	defer b.close()
+	sa.teams, sb.teams = nil, nil
+	sa.discover, sb.discover = true, true
+	server, stop := startIntegration(t, sa, sb)
+	defer stop()
+
+	waitFor(t, "kameroiden haku", func() bool {
+		switchMutex.Lock()
+		defer switchMutex.Unlock()
+		return len(cameraOwners) == 10
+	})
+	switchMutex.Lock()
+	ownerA2, ownerB2 := cameraOwners["A2"], cameraOwners["B2"]
+	switchMutex.Unlock()
+	if ownerA2 != sa || ownerB2 != sb {
+		t.Fatalf("kameroiden omistajat A2: %v, B2: %v", ownerA2, ownerB2)
+	}
+
+	observe(t, server, "76561198293547772")
+	expectVisible(t, b, "B2")
+	observe(t, server, "76561198293547782")
+	expectVisible(t, a, "A2", "Tulostaulu")
+	expectVisible(t, b)
+}
+
+// TestOBSIntegrationSlowOutput tarkistaa, ettei hidas OBS tai käynnissä oleva häivytys pysäytä
+// GSI-pakettien eikä tilarajapintojen käsittelyä
+func TestOBSIntegrationSlowOutput(t *testing.T) {
+	a, b, sa, sb := newTeamFakes(t)
+	defer a.close()
+	defer b.close()
+	server, stop := startIntegration(t, sa, sb)
+	defer stop()
+	expectVisible(t, a, "Tulostaulu")
+	transition = transitionConfig{mode: transitionFade, duration: time.Second, filter: defaultFadeFilter}
+	a.setDelay(300 * time.Millisecond)
+	b.setDelay(300 * time.Millisecond)
+
+	start := time.Now()
+	for _, sid := range []string{"76561198293547781", "76561198293547772", "76561198293547783", "76561198293547774"} {
+		resp, err := http.Post(server.URL+"/", "application/json", strings.NewReader(gsiPacket(sid, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp, err = http.Get(server.URL + "/state"); err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Errorf("GSI-paketit ja /state odottivat kameranvaihtoa %s", elapsed)
+	}
+
+	a.setDelay(0)
+	b.setDelay(0)
+	waitSwitched(t)
+	expectVisible(t, a, "Tulostaulu")
+	expectVisible(t, b, "B4")
+}
+
+// TestSwitchLatencyExcludesDelays tarkistaa, ettei switching-viive näy GSI-OBS-viiveen mittarissa
+func TestSwitchLatencyExcludesDelays(t *testing.T) {
+	server, stop := startIntegration(t, newDryRunOutput("harjoitus", "", outputRouting{teams: []string{"A", "B"}}))
+	defer stop()
+	switcher.mu.Lock()
+	switcher.setDelays(200*time.Millisecond, 0)
+	switcher.mu.Unlock()
+	latency := func() (uint64, float64) {
+		metrics.mu.Lock()
+		defer metrics.mu.Unlock()
+		return metrics.latency.count, metrics.latency.sum
+	}
+	count, sum := latency()
+
+	observe(t, server, "76561198293547781")
+	waitFor(t, "viivästetty kameranvaihto", func() bool { return store.CurrentPlayer() == "76561198293547781" })
+	waitSwitched(t)
+	newCount, newSum := latency()
+	if newCount != count+1 {
+		t.Fatalf("viiveitä mitattiin %d, odotettiin 1", newCount-count)
+	}
+	if d := newSum - sum; d >= 0.1 {
+		t.Errorf("mitattu viive %.3f s sisältää switching-viiveen", d)
+	}
+}
+
+// TestObsAuthResponse laskee autentikaatiovastauksen obs-websocketin dokumentaation esimerkistä
+func TestObsAuthResponse(t *testing.T) {
+	got := obsAuthResponse("supersecretpassword", "lM1GncleQOaCu9lT1yeUZhFYnqhsLLP1G5lAGo3ixaI=", "+IxH4CnCiqpX1rM9scsNynZzbOe4KhDeYcTNS3PDaeY=")
+	if want := "1Ct943GAT+6YQUUX47Ia/ncufilbe6+oD6lY+5kaCu4="; got != want {
+		t.Errorf("autentikaatiovastaus %s, odotettiin %s", got, want)
+	}
+}
+
+// TestOBSIntegrationAuth yhdistää salasanalla suojattuun OBS:ään molemmilla protokollilla. Väärällä
+// tai puuttuvalla salasanalla yhteys ei saa tulla käyttöön.
+func TestOBSIntegrationAuth(t *testing.T) {
+	for _, protocol := range []string{"v4", "v5"} {
+		f := newFakeOBS(protocol, "A1", "A2", "A3", "A4", "A5", "B1", "B2", "B3", "B4", "B5")
+		defer f.close()
+		f.setPassword("salasana")
+
+		for _, password := range []string{"väärä", ""} {
+			s := f.obsServer(t)
+			s.password = password
+			s.teams = []string{"A", "B"}
+			s.start()
+			waitFor(t, protocol+"-yhteyden hylkääminen", func() bool { return s.Health().LastError != "" })
+			if state := s.Health().State; state == outputUp {
+				t.Errorf("%s: salasanalla %q yhteyden tila %s", protocol, password, state)
+			}
+			s.Stop()
+		}
+
+		s := f.obsServer(t)
+		s.password = "salasana"
+		s.teams = []string{"A", "B"}
+		server, stop := startIntegration(t, s)
+		observe(t, server, "76561198293547782")
+		expectVisible(t, f, "A2")
+		stop()
+		if protocol == "v4" && f.requestCount("SetSceneItemProperties") == 0 {
+			t.Error("4.x-pyynnöt eivät menneet perille autentikaation jälkeen")
+		}
+	}
+}
+
+// TestOBSIntegrationCameraDisable poistaa lähetyksessä olevan kameran käytöstä ja palauttaa sen
+// häivytyksen aikana. Muutokset tehdään vaihtogoroutinessa, joten pyynnöt eivät odota häivytystä.
+func TestOBSIntegrationCameraDisable(t *testing.T) {
+	a, b, sa, sb := newTeamFakes(t)
+	defer a.close()
+	defer b.close()
+	server, stop := startIntegration(t, sa, sb)
+	defer stop()
+	expectVisible(t, a, "Tulostaulu")
+	transition = transitionConfig{mode: transitionFade, duration: 500 * time.Millisecond, filter: defaultFadeFilter}
+
+	post := func(path string) {
+		t.Helper()
+		start := time.Now()
+		resp, err := http.Post(server.URL+path, "application/json", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: vastaus %d, odotettiin 200", path, resp.StatusCode)
+		}
+		if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+			t.Errorf("%s odotti häivytystä %s", path, elapsed)
+		}
+	}
+
+	observe(t, server, "76561198293547781")
+	expectVisible(t, a, "A1", "Tulostaulu")
+
+	post("/cameras/A1/disable")
+	waitSwitched(t)
+	expectVisible(t, a, "Tulostaulu")
+
+	post("/cameras/A1/enable")
+	post("/cameras/A1/disable")
+	post("/cameras/A1/enable")
+	waitSwitched(t)
+	expectVisible(t, a, "A1", "Tulostaulu")
+	if current := store.CurrentPlayer(); current != "76561198293547781" {
+		t.Errorf("lähetyksessä %s, odotettiin A1:tä", current)
+	}
+}
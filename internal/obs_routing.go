@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// cameraOwners kertoo mikä videolähtö omistaa kunkin kameran. Sitä käsitellään
+// switchMutex:n suojaamana, koska löydetyt kamerat lisätään valvontagoroutinesta.
+var cameraOwners map[string]videoOutput
+
+// assignCameraOwners jakaa pelaajien kamerat lähdöille teams- ja cameras-kenttien perusteella.
+// Kamera, jota mikään lähtö ei omista, on konfiguraatiovirhe, ellei jokin lähdöistä hae
+// kameransa itse, kuten OBS-palvelin yhdistettäessä.
+func assignCameraOwners() error {
+	switchMutex.Lock()
+	defer switchMutex.Unlock()
+
+	owners, err := cameraOwnersFor(store.Roster(), outputs, nil)
+	if err != nil {
+		return err
+	}
+	cameraOwners = owners
+	return nil
+}
+
+// cameraOwnersFor jakaa rosterin kamerat lähdöille. Aiemmin löydetyt omistajat (discovered)
+// säilytetään niille kameroille, joita mikään lähtö ei omista konfiguraation perusteella.
+func cameraOwnersFor(roster *Roster, servers []videoOutput, discovered map[string]videoOutput) (map[string]videoOutput, error) {
+	owners := make(map[string]videoOutput)
+	discovering := false
+	for _, s := range servers {
+		discovering = discovering || s.discovers()
+	}
+
+	var unowned []string
+	for _, camera := range roster.Cameras() {
+		_, p, _ := roster.ByCamera(camera)
+		for _, s := range servers {
+			if !s.ownsByConfig(p) {
+				continue
+			}
+			if owner := owners[camera]; owner != nil && owner != s {
+				return nil, fmt.Errorf("kamera %s on määritelty sekä videolähdölle %s että %s", camera, owner.name(), s.name())
+			}
+			owners[camera] = s
+		}
+		if owners[camera] == nil && discovered[camera] != nil && discovered[camera].discovers() {
+			owners[camera] = discovered[camera]
+		}
+		if owners[camera] == nil {
+			unowned = append(unowned, camera)
+		}
+	}
+
+	if len(unowned) > 0 {
+		if !discovering {
+			return nil, fmt.Errorf("kameroita %s ei ole määritelty millekään videolähdölle", strings.Join(unowned, ", "))
+		}
+		log.Printf("Kameroiden %s videolähtö selviää vasta yhdistettäessä", strings.Join(unowned, ", "))
+	}
+	return owners, nil
+}
+
+// discoverCameras hakee palvelimen scenen lähteet ja merkitsee niistä pelaajien kamerat
+// palvelimen omistamiksi
+func (obs *obsServer) discoverCameras() {
+	ctx, cancel := context.WithTimeout(context.Background(), obsRequestTimeout)
+	defer cancel()
+	items, err := obs.protocol.sceneItems(ctx, obs, obs.scene)
+	if err != nil {
+		log.Printf("Kameroiden haku OBS-palvelimelta %s epäonnistui: %s", obs.host(), err)
+		return
+	}
+
+	switchMutex.Lock()
+	defer switchMutex.Unlock()
+
+	roster := store.Roster()
+	for _, item := range items {
+		if _, _, ok := roster.ByCamera(item); !ok {
+			continue
+		}
+		if owner := cameraOwners[item]; owner != nil && owner != obs {
+			log.Printf("Kamera %s löytyi myös OBS-palvelimelta %s, käytetään videolähtöä %s", item, obs.host(), owner.name())
+			continue
+		}
+		cameraOwners[item] = obs
+		log.Printf("Kamera %s löytyi OBS-palvelimelta %s", item, obs.host())
+	}
+}
+
+// stringList lukee konfiguraation valinnaisen merkkijonolistan
+func stringList(v interface{}) ([]string, error) {
+	if v == nil {
+		return nil, nil
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("odotettiin listaa merkkijonoja, saatiin %v", v)
+	}
+	strs := make([]string, len(list))
+	for i, item := range list {
+		if strs[i], ok = item.(string); !ok {
+			return nil, fmt.Errorf("odotettiin merkkijonoa, saatiin %v", item)
+		}
+	}
+	return strs, nil
+}
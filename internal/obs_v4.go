@@ -0,0 +1,159 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/gorilla/websocket"
+)
+
+type (
+	// obsV4 toteuttaa obs-websocket 4.x protokollan (request-type/message-id)
+	obsV4 struct{}
+
+	obsV4Request struct {
+		RequestType string `json:"request-type"`
+		MessageId   string `json:"message-id"`
+		Auth        string `json:"auth,omitempty"`
+	}
+
+	obsV4Response struct {
+		MessageId string `json:"message-id"`
+		Status    string `json:"status"`
+		Error     string `json:"error"`
+	}
+
+	obsV4AuthRequired struct {
+		obsV4Response
+		AuthRequired bool   `json:"authRequired"`
+		Challenge    string `json:"challenge"`
+		Salt         string `json:"salt"`
+	}
+)
+
+func (p *obsV4) name() string {
+	return "v4"
+}
+
+// handshake tarkistaa GetAuthRequired-pyynnöllä vaatiiko OBS autentikaation ja
+// suorittaa tarvittaessa Authenticate-pyynnön. Ilman autentikaatiota yhteys on käytettävissä heti.
+func (p *obsV4) handshake(conn *websocket.Conn, password string) error {
+	var authRequired obsV4AuthRequired
+	if err := obsV4Call(conn, obsV4Request{RequestType: "GetAuthRequired"}, &authRequired); err != nil {
+		return err
+	}
+	if !authRequired.AuthRequired {
+		return nil
+	}
+	if password == "" {
+		return fmt.Errorf("OBS vaatii autentikaation, mutta salasanaa ei ole konfiguroitu")
+	}
+
+	var resp obsV4Response
+	return obsV4Call(conn, obsV4Request{
+		RequestType: "Authenticate",
+		Auth:        obsAuthResponse(password, authRequired.Salt, authRequired.Challenge),
+	}, &resp)
+}
+
+// encodeRequest lisää pyynnön kentät viestin päätasolle request-typen ja message-id:n rinnalle
+func (p *obsV4) encodeRequest(id, requestType string, data map[string]interface{}) interface{} {
+	msg := map[string]interface{}{
+		"request-type": requestType,
+		"message-id":   id,
+	}
+	for k, v := range data {
+		msg[k] = v
+	}
+	return msg
+}
+
+// decodeResponse tunnistaa vastaukset message-id:stä, tapahtumaviesteissä (update-type) sitä ei ole
+func (p *obsV4) decodeResponse(raw []byte) (obsResponse, bool) {
+	var resp obsV4Response
+	if err := json.Unmarshal(raw, &resp); err != nil || resp.MessageId == "" {
+		return obsResponse{}, false
+	}
+	if resp.Status != "ok" {
+		return obsResponse{id: resp.MessageId, error: resp.Error}, true
+	}
+	return obsResponse{id: resp.MessageId, data: raw}, true
+}
+
+func (p *obsV4) setVisibility(ctx context.Context, obs *obsServer, scene, item string, visible bool) error {
+	_, err := obs.Request(ctx, "SetSceneItemProperties", map[string]interface{}{
+		"item":       item,
+		"visible":    visible,
+		"scene-name": scene,
+	})
+	return err
+}
+
+// setOpacity käyttää OBS 27:n Color Correction -suodattimen asteikkoa 0..100
+func (p *obsV4) setOpacity(ctx context.Context, obs *obsServer, source, filter string, opacity float64) error {
+	_, err := obs.Request(ctx, "SetSourceFilterSettings", map[string]interface{}{
+		"sourceName":     source,
+		"filterName":     filter,
+		"filterSettings": map[string]interface{}{"opacity": int(opacity*100 + 0.5)},
+	})
+	return err
+}
+
+// obsV4Call lähettää kättelyn aikaisen pyynnön ja lukee sitä vastaavan vastauksen.
+// Lukijagoroutine ei ole vielä käynnissä, joten muut viestit ohitetaan.
+func obsV4Call(conn *websocket.Conn, req obsV4Request, v interface{}) error {
+	req.MessageId = "pkm-" + req.RequestType
+	if err := conn.WriteJSON(req); err != nil {
+		return err
+	}
+
+	for {
+		_, raw, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		var resp obsV4Response
+		if err = json.Unmarshal(raw, &resp); err != nil {
+			return err
+		}
+		if resp.MessageId != req.MessageId {
+			continue
+		}
+		if resp.Status != "ok" {
+			return &obsRequestError{req.RequestType, resp.Error}
+		}
+		return json.Unmarshal(raw, v)
+	}
+}
+
+// sceneItems lukee scenen lähteet GetSceneList-vastauksesta, joka on käytettävissä kaikissa 4.x versioissa
+func (p *obsV4) sceneItems(ctx context.Context, obs *obsServer, scene string) ([]string, error) {
+	data, err := obs.Request(ctx, "GetSceneList", nil)
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Scenes []struct {
+			Name    string `json:"name"`
+			Sources []struct {
+				Name string `json:"name"`
+			} `json:"sources"`
+		} `json:"scenes"`
+	}
+	if err = json.Unmarshal(data, &resp); err != nil {
+		return nil, err
+	}
+
+	for _, s := range resp.Scenes {
+		if s.Name != scene {
+			continue
+		}
+		items := make([]string, len(s.Sources))
+		for i, source := range s.Sources {
+			items[i] = source.Name
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("scenea %s ei löytynyt", scene)
+}
@@ -0,0 +1,232 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	obsV5RPCVersion = 1
+
+	// obs-websocket 5.x viestien op-koodit
+	obsV5OpHello           = 0
+	obsV5OpIdentify        = 1
+	obsV5OpIdentified      = 2
+	obsV5OpRequest         = 6
+	obsV5OpRequestResponse = 7
+)
+
+type (
+	// obsV5 toteuttaa obs-websocket 5.x protokollan (OBS 28 ->)
+	obsV5 struct {
+		// sceneItemId:t haetaan OBS:ltä kerran per scene ja lähde
+		mu           sync.Mutex
+		sceneItemIds map[string]int
+	}
+
+	obsV5Message struct {
+		Op int             `json:"op"`
+		D  json.RawMessage `json:"d"`
+	}
+
+	obsV5Hello struct {
+		ObsWebSocketVersion string `json:"obsWebSocketVersion"`
+		RPCVersion          int    `json:"rpcVersion"`
+		Authentication      *struct {
+			Challenge string `json:"challenge"`
+			Salt      string `json:"salt"`
+		} `json:"authentication,omitempty"`
+	}
+
+	obsV5Identify struct {
+		RPCVersion         int    `json:"rpcVersion"`
+		Authentication     string `json:"authentication,omitempty"`
+		EventSubscriptions int    `json:"eventSubscriptions"`
+	}
+
+	obsV5Request struct {
+		RequestType string      `json:"requestType"`
+		RequestId   string      `json:"requestId"`
+		RequestData interface{} `json:"requestData,omitempty"`
+	}
+
+	obsV5RequestResponse struct {
+		RequestType   string `json:"requestType"`
+		RequestId     string `json:"requestId"`
+		RequestStatus struct {
+			Result  bool   `json:"result"`
+			Code    int    `json:"code"`
+			Comment string `json:"comment"`
+		} `json:"requestStatus"`
+		ResponseData json.RawMessage `json:"responseData"`
+	}
+)
+
+func newObsV5() *obsV5 {
+	return &obsV5{sceneItemIds: make(map[string]int)}
+}
+
+func (p *obsV5) name() string {
+	return "v5"
+}
+
+// handshake suorittaa Hello/Identify/Identified -kättelyn. Jos Hello-viestissä on
+// authentication-kenttä, Identify-viestiin lasketaan vastaus salasanan perusteella.
+func (p *obsV5) handshake(conn *websocket.Conn, password string) error {
+	// OBS:n uudelleenkäynnistyksen jälkeen sceneItemId:t voivat olla muuttuneet
+	p.mu.Lock()
+	p.sceneItemIds = make(map[string]int)
+	p.mu.Unlock()
+
+	var hello obsV5Hello
+	if err := obsV5Read(conn, obsV5OpHello, &hello); err != nil {
+		return fmt.Errorf("Hello-viestin luku epäonnistui: %s", err)
+	}
+
+	identify := obsV5Identify{RPCVersion: obsV5RPCVersion}
+	if hello.Authentication != nil {
+		if password == "" {
+			return fmt.Errorf("OBS vaatii autentikaation, mutta salasanaa ei ole konfiguroitu")
+		}
+		identify.Authentication = obsAuthResponse(password, hello.Authentication.Salt, hello.Authentication.Challenge)
+	}
+
+	if err := conn.WriteJSON(obsV5Message{Op: obsV5OpIdentify, D: mustMarshal(identify)}); err != nil {
+		return fmt.Errorf("Identify-viestin lähetys epäonnistui: %s", err)
+	}
+	// Väärän salasanan tapauksessa OBS sulkee yhteyden, jolloin luku palauttaa sulkemissyyn
+	if err := obsV5Read(conn, obsV5OpIdentified, nil); err != nil {
+		return fmt.Errorf("Identified-viestin luku epäonnistui: %s", err)
+	}
+	return nil
+}
+
+func (p *obsV5) encodeRequest(id, requestType string, data map[string]interface{}) interface{} {
+	return obsV5Message{Op: obsV5OpRequest, D: mustMarshal(obsV5Request{
+		RequestType: requestType,
+		RequestId:   id,
+		RequestData: data,
+	})}
+}
+
+// decodeResponse poimii RequestResponse-viestit, muut (esim. tapahtumat) ohitetaan
+func (p *obsV5) decodeResponse(raw []byte) (obsResponse, bool) {
+	var msg obsV5Message
+	if err := json.Unmarshal(raw, &msg); err != nil || msg.Op != obsV5OpRequestResponse {
+		return obsResponse{}, false
+	}
+	var resp obsV5RequestResponse
+	if err := json.Unmarshal(msg.D, &resp); err != nil {
+		return obsResponse{}, false
+	}
+	if !resp.RequestStatus.Result {
+		return obsResponse{id: resp.RequestId,
+			error: fmt.Sprintf("%d %s", resp.RequestStatus.Code, resp.RequestStatus.Comment)}, true
+	}
+	return obsResponse{id: resp.RequestId, data: resp.ResponseData}, true
+}
+
+// setVisibility hakee lähteen sceneItemId:n ja lähettää SetSceneItemEnabled-komennon
+func (p *obsV5) setVisibility(ctx context.Context, obs *obsServer, scene, item string, visible bool) error {
+	id, err := p.sceneItemId(ctx, obs, scene, item)
+	if err != nil {
+		return err
+	}
+
+	_, err = obs.Request(ctx, "SetSceneItemEnabled", map[string]interface{}{
+		"sceneName":        scene,
+		"sceneItemId":      id,
+		"sceneItemEnabled": visible,
+	})
+	return err
+}
+
+// setOpacity käyttää OBS 28:n Color Correction -suodattimen asteikkoa 0..1
+func (p *obsV5) setOpacity(ctx context.Context, obs *obsServer, source, filter string, opacity float64) error {
+	_, err := obs.Request(ctx, "SetSourceFilterSettings", map[string]interface{}{
+		"sourceName":     source,
+		"filterName":     filter,
+		"filterSettings": map[string]interface{}{"opacity": opacity},
+		"overlay":        true,
+	})
+	return err
+}
+
+func (p *obsV5) sceneItemId(ctx context.Context, obs *obsServer, scene, item string) (int, error) {
+	key := scene + "/" + item
+	p.mu.Lock()
+	id, ok := p.sceneItemIds[key]
+	p.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	data, err := obs.Request(ctx, "GetSceneItemId", map[string]interface{}{
+		"sceneName":  scene,
+		"sourceName": item,
+	})
+	if err != nil {
+		return 0, err
+	}
+	var resp struct {
+		SceneItemId int `json:"sceneItemId"`
+	}
+	if err = json.Unmarshal(data, &resp); err != nil {
+		return 0, err
+	}
+
+	p.mu.Lock()
+	p.sceneItemIds[key] = resp.SceneItemId
+	p.mu.Unlock()
+	return resp.SceneItemId, nil
+}
+
+// obsV5Read lukee viestejä kunnes saadaan halutulla op-koodilla varustettu viesti
+func obsV5Read(conn *websocket.Conn, op int, v interface{}) error {
+	for {
+		var msg obsV5Message
+		if err := conn.ReadJSON(&msg); err != nil {
+			return err
+		}
+		if msg.Op != op {
+			continue
+		}
+		if v == nil {
+			return nil
+		}
+		return json.Unmarshal(msg.D, v)
+	}
+}
+
+func mustMarshal(v interface{}) json.RawMessage {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func (p *obsV5) sceneItems(ctx context.Context, obs *obsServer, scene string) ([]string, error) {
+	data, err := obs.Request(ctx, "GetSceneItemList", map[string]interface{}{"sceneName": scene})
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		SceneItems []struct {
+			SourceName string `json:"sourceName"`
+		} `json:"sceneItems"`
+	}
+	if err = json.Unmarshal(data, &resp); err != nil {
+		return nil, err
+	}
+
+	items := make([]string, len(resp.SceneItems))
+	for i, item := range resp.SceneItems {
+		items[i] = item.SourceName
+	}
+	return items, nil
+}
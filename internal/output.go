@@ -0,0 +1,309 @@
+package internal
+
+import (
+	"fmt"
+	"github.com/jmoiron/jsonq"
+	"log"
+	"reflect"
+	"time"
+)
+
+// Videolähtöjen tyypit outputs-listan type-kentässä
+const (
+	outputOBS    = "obs"
+	outputHTTP   = "http"
+	outputDryRun = "dry-run"
+)
+
+// Videolähdön tilat
+const (
+	outputConnecting = "connecting"
+	outputUp         = "up"
+	outputDown       = "down"
+)
+
+type (
+	// videoOutput on videolähtö, jonka kautta pelaajakamerat tuodaan lähetykseen. Jokainen kamera
+	// kuuluu yhdelle lähdölle (cameraOwners), ja kamerakomennot annetaan switchMutex:n suojaamina.
+	videoOutput interface {
+		// name yksilöi lähdön lokeissa ja rajapinnoissa, esim. OBS-palvelimen osoite
+		name() string
+		ShowCamera(camera string)
+		HideCamera(camera string)
+		// HideAll piilottaa kaikki lähdön omistamat kamerat
+		HideAll()
+		// Health kertoo lähdön tilan /servers-, /status- ja /metrics-rajapinnoille
+		Health() outputStatus
+
+		// start käynnistää lähdön ja Stop pysäyttää sen
+		start()
+		Stop()
+		// restore palauttaa lähdön kamerat lähetyksen mukaisiksi esim. uudelleenlatauksen jälkeen
+		restore()
+
+		// Konfiguraatiosta luettu kameroiden jako, ks. outputRouting
+		ownsByConfig(p Player) bool
+		discovers() bool
+		configEntry() map[string]interface{}
+	}
+
+	// opacityOutput on lähtö, joka osaa häivyttää kameroita. Muilla lähdöillä fade-siirtymä on leikkaus.
+	opacityOutput interface {
+		SetOpacity(camera string, opacity float64)
+	}
+
+	// cameraLister on lähtö, jolta voi kysyä sen tuntemat kamerat käynnistyksen tarkistusta varten
+	cameraLister interface {
+		listCameras() ([]string, error)
+	}
+
+	// outputRouting on kaikille lähdöille yhteinen osa konfiguraatiota. Lähdön kamerat määritellään
+	// joukkueen kirjaimella (teams) tai kameroiden nimillä (cameras). Jos kumpaakaan ei ole annettu,
+	// lähtö hakee kameransa itse, mikäli se osaa.
+	outputRouting struct {
+		teams    []string
+		cameras  []string
+		discover bool
+		// entry on lähdön konfiguraatiomerkintä, jonka muutokset tulevat voimaan vasta uudelleenkäynnistyksessä
+		entry map[string]interface{}
+	}
+
+	// outputHealth kertoo videolähdön tilan /servers-rajapinnalle
+	outputHealth struct {
+		State      string    `json:"state"`
+		Since      time.Time `json:"since"`
+		LastError  string    `json:"last_error,omitempty"`
+		Reconnects int       `json:"reconnects"`
+	}
+
+	outputStatus struct {
+		Address  string `json:"address"`
+		Kind     string `json:"kind"`
+		Protocol string `json:"protocol,omitempty"`
+		outputHealth
+		// Kameroiden viimeisimmät epäonnistuneet komennot, onnistunut komento poistaa merkinnän
+		CameraErrors map[string]string `json:"camera_errors,omitempty"`
+		// Pyyntölaskurit /metrics-rajapinnalle
+		RequestsSent   uint64 `json:"-"`
+		RequestsFailed uint64 `json:"-"`
+	}
+)
+
+// outputs ovat konfiguroidut videolähdöt camera_servers-listan ja outputs-listan järjestyksessä
+var outputs []videoOutput
+
+// loadOutputs lukee videolähdöt. camera_servers-listan merkinnät ovat OBS-palvelimia, outputs-listan
+// merkinnöillä on type-kenttä. Lähtöjä ei vielä käynnistetä.
+func loadOutputs(cq *jsonq.JsonQuery) ([]videoOutput, error) {
+	var list []videoOutput
+	for _, key := range []string{"camera_servers", "outputs"} {
+		if _, err := cq.Interface(key); err != nil {
+			continue
+		}
+		entries, err := cq.ArrayOfObjects(key)
+		if err != nil {
+			return nil, fmt.Errorf("%s-listan luku epäonnistui: %s", key, err)
+		}
+		for i, entry := range entries {
+			kind := outputOBS
+			if key == "outputs" {
+				kind, _ = entry["type"].(string)
+			}
+			// Merkintää ei tulosteta virheilmoituksiin, koska siinä voi olla salasanoja
+			o, err := newOutput(kind, fmt.Sprintf("%s-listan %d. merkintä", key, i+1), entry)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, o)
+		}
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("videolähtöjä ei ole määritelty, camera_servers tai outputs on pakollinen")
+	}
+	return list, nil
+}
+
+// newOutput luo konfiguraatiomerkinnän mukaisen lähdön. label yksilöi merkinnän virheilmoituksissa.
+// Kuivaharjoituksessa kaikki lähdöt korvataan virtuaalisilla sceneillä.
+func newOutput(kind, label string, entry map[string]interface{}) (videoOutput, error) {
+	routing, err := loadOutputRouting(entry)
+	if err != nil {
+		return nil, fmt.Errorf("videolähdön konfiguraatio (%s) on virheellinen: %s", label, err)
+	}
+
+	var o videoOutput
+	switch kind {
+	case outputOBS:
+		obs, err := loadObsServer(entry, routing)
+		if err != nil {
+			return nil, err
+		}
+		if dryRun || entry["protocol"] == outputDryRun {
+			return newDryRunOutput(obs.host(), obs.scene, routing), nil
+		}
+		o = obs
+	case outputHTTP:
+		if o, err = loadHTTPOutput(entry, label, routing); err != nil {
+			return nil, err
+		}
+	case outputDryRun:
+		name, _ := entry["name"].(string)
+		if name == "" {
+			return nil, fmt.Errorf("videolähdön (%s) name on pakollinen", label)
+		}
+		scene, _ := entry["scene"].(string)
+		return newDryRunOutput(name, scene, routing), nil
+	default:
+		return nil, fmt.Errorf("videolähdön (%s) tyyppi %q on tuntematon, sallitut arvot ovat \"%s\", \"%s\" ja \"%s\"",
+			label, kind, outputOBS, outputHTTP, outputDryRun)
+	}
+
+	if dryRun {
+		return newDryRunOutput(o.name(), "", routing), nil
+	}
+	return o, nil
+}
+
+func loadOutputRouting(entry map[string]interface{}) (outputRouting, error) {
+	var err error
+	r := outputRouting{entry: entry}
+	if r.teams, err = stringList(entry["teams"]); err != nil {
+		return r, fmt.Errorf("teams-kenttä on virheellinen: %s", err)
+	}
+	if r.cameras, err = stringList(entry["cameras"]); err != nil {
+		return r, fmt.Errorf("cameras-kenttä on virheellinen: %s", err)
+	}
+	r.discover = len(r.teams) == 0 && len(r.cameras) == 0
+	return r, nil
+}
+
+func (r *outputRouting) ownsByConfig(p Player) bool {
+	for _, team := range r.teams {
+		if team == p.Team {
+			return true
+		}
+	}
+	for _, camera := range r.cameras {
+		if camera == p.Camera {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *outputRouting) discovers() bool {
+	return r.discover
+}
+
+func (r *outputRouting) configEntry() map[string]interface{} {
+	return r.entry
+}
+
+// startOutputs jakaa kamerat lähdöille ja käynnistää lähdöt
+func startOutputs() {
+	var err error
+	if outputs, err = loadOutputs(CQ); err != nil {
+		log.Fatal(err)
+	}
+
+	if err = assignCameraOwners(); err != nil {
+		log.Fatalf("Kameroiden jako videolähdöille epäonnistui: %s", err)
+	}
+
+	for _, o := range outputs {
+		o.start()
+	}
+}
+
+// sameOutputs vertaa videolähtöjen konfiguraatiota käytössä oleviin lähtöihin
+func sameOutputs(a, b []videoOutput) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].name() != b[i].name() || !reflect.DeepEqual(a[i].configEntry(), b[i].configEntry()) {
+			return false
+		}
+	}
+	return true
+}
+
+func setCameraVisibility(camera string, visible bool) {
+	if camera == "" {
+		return
+	}
+	owner := cameraOwners[camera]
+	if owner == nil {
+		log.Printf("Kameraa %s ei ole millään videolähdöllä, näkyvyyttä ei muutettu", camera)
+		return
+	}
+	if visible {
+		owner.ShowCamera(camera)
+	} else {
+		owner.HideCamera(camera)
+	}
+}
+
+func hideAllCameras() {
+	for _, o := range outputs {
+		o.HideAll()
+	}
+}
+
+// ownedCameras palauttaa rosterin kamerat, jotka kuuluvat lähdölle o. Kutsujalla on switchMutex.
+func ownedCameras(o videoOutput) []string {
+	var cameras []string
+	for _, camera := range store.Roster().Cameras() {
+		if cameraOwners[camera] == o {
+			cameras = append(cameras, camera)
+		}
+	}
+	return cameras
+}
+
+// restoreCameras tuo lähdön valittuna olevan kameran näkyviin ja piilottaa sen muut kamerat.
+// Käytöstä poistettu kamera piilotetaan muiden mukana.
+func restoreCameras(o videoOutput) {
+	switchMutex.Lock()
+	defer switchMutex.Unlock()
+
+	var current string
+	if p, ok := store.Roster().BySteamID(store.CurrentPlayer()); ok && !store.CameraDisabled(p.Camera) {
+		current = p.Camera
+	}
+	for _, camera := range ownedCameras(o) {
+		if camera != current {
+			o.HideCamera(camera)
+		}
+	}
+	log.Printf("Videolähdön %s kamerakuvat piilotettu", o.name())
+	if current != "" && cameraOwners[current] == o {
+		if f, ok := o.(opacityOutput); ok && transition.mode == transitionFade {
+			// Yhteys on voinut katketa kesken häivytyksen
+			f.SetOpacity(current, 1)
+		}
+		o.ShowCamera(current)
+		log.Printf("Kamera %s palautettu näkyviin videolähdölle %s", current, o.name())
+	}
+}
+
+// waitUntilUp odottaa kunnes lähde on käytettävissä
+func waitUntilUp(o videoOutput, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if o.Health().State == outputUp {
+			return true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return o.Health().State == outputUp
+}
+
+// outputStatuses palauttaa kaikkien videolähtöjen tilan
+func outputStatuses() []outputStatus {
+	statuses := make([]outputStatus, len(outputs))
+	for i, o := range outputs {
+		statuses[i] = o.Health()
+	}
+	return statuses
+}
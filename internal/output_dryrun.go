@@ -0,0 +1,188 @@
+package internal
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+type (
+	// dryRunOutput on kuivaharjoituksen videolähtö. Lähtöön ei yhdistetä, vaan komennot kohdistetaan
+	// virtuaaliseen sceneen, jonka tila näkyy /state-rajapinnassa. Kameroiden jaon lähdöille ja
+	// paikoille voi näin tarkistaa etukäteen ilman videoservereitä.
+	dryRunOutput struct {
+		outputRouting
+		address string
+		scene   string
+		started time.Time
+
+		mu      sync.Mutex
+		visible map[string]bool
+		opacity map[string]float64
+	}
+
+	// dryRunScene on kuivaharjoituslähdön virtuaalisen scenen tila
+	dryRunScene struct {
+		Server  string         `json:"server"`
+		Scene   string         `json:"scene,omitempty"`
+		Cameras []dryRunCamera `json:"cameras"`
+	}
+
+	dryRunCamera struct {
+		Camera     string  `json:"camera"`
+		Seat       string  `json:"seat,omitempty"`
+		PlayerName string  `json:"player_name,omitempty"`
+		Visible    bool    `json:"visible"`
+		Opacity    float64 `json:"opacity"`
+	}
+)
+
+// newDryRunOutput luo virtuaalisen scenen lähdölle, joka tunnetaan nimellä address
+func newDryRunOutput(address, scene string, routing outputRouting) *dryRunOutput {
+	return &dryRunOutput{
+		outputRouting: routing,
+		address:       address,
+		scene:         scene,
+		started:       time.Now(),
+		visible:       make(map[string]bool),
+		opacity:       make(map[string]float64),
+	}
+}
+
+func (d *dryRunOutput) name() string {
+	return d.address
+}
+
+func (d *dryRunOutput) ShowCamera(camera string) {
+	d.setVisibility(camera, true)
+}
+
+func (d *dryRunOutput) HideCamera(camera string) {
+	d.setVisibility(camera, false)
+}
+
+// HideAll piilottaa lähdön kamerat. Kutsujalla on switchMutex.
+func (d *dryRunOutput) HideAll() {
+	for _, camera := range ownedCameras(d) {
+		d.setVisibility(camera, false)
+	}
+}
+
+func (d *dryRunOutput) setVisibility(camera string, visible bool) {
+	d.mu.Lock()
+	changed := d.visible[camera] != visible
+	d.visible[camera] = visible
+	d.mu.Unlock()
+
+	if changed {
+		state := "piiloon"
+		if visible {
+			state = "näkyviin"
+		}
+		log.Printf("Kuivaharjoitus: kamera %s %s videolähdöllä %s", camera, state, d.address)
+	}
+}
+
+func (d *dryRunOutput) SetOpacity(camera string, opacity float64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.opacity[camera] = opacity
+}
+
+// Health kertoo lähdön olevan aina käytettävissä
+func (d *dryRunOutput) Health() outputStatus {
+	return outputStatus{
+		Address:      d.address,
+		Kind:         outputDryRun,
+		outputHealth: outputHealth{State: outputUp, Since: d.started},
+	}
+}
+
+func (d *dryRunOutput) start() {
+	log.Printf("Kuivaharjoitus: videolähtöön %s ei yhdistetä", d.address)
+	d.restore()
+}
+
+func (d *dryRunOutput) Stop() {}
+
+// restore jakaa kamerat ja palauttaa virtuaalisen scenen lähetyksen mukaiseksi. Kameroita hakevista
+// lähdöistä ensimmäinen saa kaikki kamerat, joita mikään lähtö ei omista konfiguraation perusteella.
+func (d *dryRunOutput) restore() {
+	if d.discover {
+		switchMutex.Lock()
+		var discovering videoOutput
+		for _, o := range outputs {
+			if o.discovers() {
+				discovering = o
+				break
+			}
+		}
+		if discovering == d {
+			for _, camera := range store.Roster().Cameras() {
+				if cameraOwners[camera] == nil {
+					cameraOwners[camera] = d
+				}
+			}
+		}
+		switchMutex.Unlock()
+	}
+	restoreCameras(d)
+}
+
+// virtualScene kokoaa virtuaalisen scenen tilan. Kutsujalla on switchMutex.
+func (d *dryRunOutput) virtualScene() dryRunScene {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	roster := store.Roster()
+	cameras := make(map[string]bool)
+	for camera, owner := range cameraOwners {
+		if owner == d {
+			cameras[camera] = true
+		}
+	}
+	// Myös sellaiset kamerat, joita lähdölle on komennettu ennen uudelleenlatausta
+	for camera := range d.visible {
+		cameras[camera] = true
+	}
+
+	scene := dryRunScene{Server: d.address, Scene: d.scene, Cameras: []dryRunCamera{}}
+	for camera := range cameras {
+		c := dryRunCamera{Camera: camera, Visible: d.visible[camera], Opacity: 1}
+		if opacity, ok := d.opacity[camera]; ok {
+			c.Opacity = opacity
+		}
+		if _, player, ok := roster.ByCamera(camera); ok {
+			c.Seat = player.Seat()
+			c.PlayerName = player.PlayerName
+		}
+		scene.Cameras = append(scene.Cameras, c)
+	}
+	sort.Slice(scene.Cameras, func(i, j int) bool {
+		return scene.Cameras[i].Camera < scene.Cameras[j].Camera
+	})
+	return scene
+}
+
+// dryRunScenes palauttaa kuivaharjoituslähtöjen virtuaaliset scenet, nil jos niitä ei ole. Ilman
+// kuivaharjoituslähtöjä switchMutex:ia ei oteta, jottei /state odota kameranvaihtoja.
+func dryRunScenes() []dryRunScene {
+	var dryRunOutputs []*dryRunOutput
+	for _, o := range outputs {
+		if d, ok := o.(*dryRunOutput); ok {
+			dryRunOutputs = append(dryRunOutputs, d)
+		}
+	}
+	if len(dryRunOutputs) == 0 {
+		return nil
+	}
+
+	switchMutex.Lock()
+	defer switchMutex.Unlock()
+	scenes := make([]dryRunScene, len(dryRunOutputs))
+	for i, d := range dryRunOutputs {
+		scenes[i] = d.virtualScene()
+	}
+	return scenes
+}
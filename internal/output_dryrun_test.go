@@ -0,0 +1,75 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// TestDryRun ajaa kameranvaihdot virtuaalisiin sceneihin ja lukee niiden tilan /state-rajapinnasta
+func TestDryRun(t *testing.T) {
+	sa := newDryRunOutput("10.0.0.1:4444", defaultSceneName, outputRouting{teams: []string{"A"}})
+	// Kameroita hakeva lähtö saa kuivaharjoituksessa kaikki muille kuulumattomat kamerat
+	sb := newDryRunOutput("10.0.0.2:4455", defaultSceneName, outputRouting{discover: true})
+	server, stop := startIntegration(t, sa, sb)
+	defer stop()
+
+	state := func() (scenes []dryRunScene) {
+		t.Helper()
+		resp, err := http.Get(server.URL + "/state")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body struct {
+			DryRun []dryRunScene `json:"dry_run"`
+		}
+		if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		return body.DryRun
+	}
+	visible := func(scene dryRunScene) []string {
+		cameras := []string{}
+		for _, c := range scene.Cameras {
+			if c.Visible {
+				cameras = append(cameras, c.Camera)
+			}
+		}
+		return cameras
+	}
+
+	waitFor(t, "kameroiden jako", func() bool {
+		scenes := state()
+		return len(scenes) == 2 && len(scenes[0].Cameras) == 5 && len(scenes[1].Cameras) == 5
+	})
+	scenes := state()
+	if scenes[0].Server != "10.0.0.1:4444" || scenes[1].Server != "10.0.0.2:4455" {
+		t.Fatalf("virtuaaliset scenet %+v", scenes)
+	}
+	if c := scenes[1].Cameras[2]; c.Camera != "B3" || c.Seat != "B3" || c.PlayerName != "B3" || c.Visible {
+		t.Errorf("kameran B3 tila %+v", c)
+	}
+
+	observe(t, server, "76561198293547772")
+	scenes = state()
+	if got := visible(scenes[0]); !reflect.DeepEqual(got, []string{}) {
+		t.Errorf("A-palvelimella näkyvissä %v", got)
+	}
+	if got := visible(scenes[1]); !reflect.DeepEqual(got, []string{"B2"}) {
+		t.Errorf("B-palvelimella näkyvissä %v, odotettiin [B2]", got)
+	}
+
+	observe(t, server, "76561198293547785")
+	scenes = state()
+	if got := visible(scenes[0]); !reflect.DeepEqual(got, []string{"A5"}) {
+		t.Errorf("A-palvelimella näkyvissä %v, odotettiin [A5]", got)
+	}
+	if got := visible(scenes[1]); !reflect.DeepEqual(got, []string{}) {
+		t.Errorf("B-palvelimella näkyvissä %v", got)
+	}
+	if s := sa.Health(); s.State != outputUp || s.Kind != outputDryRun {
+		t.Errorf("kuivaharjoituslähdön tila %s (%s)", s.State, s.Kind)
+	}
+}
@@ -0,0 +1,199 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const httpOutputTimeout = 2 * time.Second
+
+// httpOutput on videolähtö, joka ohjaa kameroita HTTP-pyynnöillä, esim. vMixin tai Bitfocus
+// Companionin rajapinnan kautta. Osoitteissa {camera} korvataan kameran nimellä ja {seat}
+// pelaajan paikalla (esim. "A1"). Ilman hide_url-osoitetta kameroita ei piiloteta erikseen,
+// mikä sopii leikkaaville kuvamiksereille.
+type httpOutput struct {
+	outputRouting
+	address string
+	method  string
+	showURL string
+	hideURL string
+	client  *http.Client
+
+	mu             sync.Mutex
+	health         outputHealth
+	cameraErrors   map[string]string
+	requestsSent   uint64
+	requestsFailed uint64
+}
+
+// loadHTTPOutput lukee outputs-listan http-tyyppisen merkinnän. Osoitteissa voi olla API-avaimia,
+// joten virheilmoitukset yksilöivät merkinnän label-tunnisteella.
+func loadHTTPOutput(v map[string]interface{}, label string, routing outputRouting) (*httpOutput, error) {
+	h := &httpOutput{
+		outputRouting: routing,
+		method:        http.MethodGet,
+		client:        &http.Client{Timeout: httpOutputTimeout},
+		health:        outputHealth{State: outputUp, Since: time.Now()},
+		cameraErrors:  make(map[string]string),
+	}
+	h.showURL, _ = v["show_url"].(string)
+	h.hideURL, _ = v["hide_url"].(string)
+	show, err := url.Parse(h.showURL)
+	if err != nil || (show.Scheme != "http" && show.Scheme != "https") {
+		return nil, fmt.Errorf("HTTP-videolähdön (%s) show_url on pakollinen http- tai https-osoite", label)
+	}
+	if h.hideURL != "" {
+		if hide, err := url.Parse(h.hideURL); err != nil || (hide.Scheme != "http" && hide.Scheme != "https") {
+			return nil, fmt.Errorf("HTTP-videolähdön (%s) hide_url ei ole http- tai https-osoite", label)
+		}
+	}
+	if method, ok := v["method"].(string); ok {
+		h.method = strings.ToUpper(method)
+	}
+	if h.method != http.MethodGet && h.method != http.MethodPost && h.method != http.MethodPut {
+		return nil, fmt.Errorf("HTTP-videolähdön (%s) method on virheellinen, sallitut arvot ovat GET, POST ja PUT", label)
+	}
+	if h.address, _ = v["name"].(string); h.address == "" {
+		h.address = show.Host
+	}
+	if routing.discover {
+		return nil, fmt.Errorf("HTTP-videolähdölle %s pitää määritellä teams tai cameras", h.address)
+	}
+	return h, nil
+}
+
+func (h *httpOutput) name() string {
+	return h.address
+}
+
+func (h *httpOutput) ShowCamera(camera string) {
+	h.send(h.showURL, camera)
+}
+
+func (h *httpOutput) HideCamera(camera string) {
+	h.send(h.hideURL, camera)
+}
+
+// HideAll piilottaa lähdön kamerat. Kutsujalla on switchMutex.
+func (h *httpOutput) HideAll() {
+	if h.hideURL == "" {
+		return
+	}
+	for _, camera := range ownedCameras(h) {
+		h.send(h.hideURL, camera)
+	}
+}
+
+func (h *httpOutput) start() {
+	log.Printf("HTTP-videolähtö %s käytössä (%s)", h.address, h.method)
+	h.restore()
+}
+
+func (h *httpOutput) Stop() {}
+
+func (h *httpOutput) restore() {
+	restoreCameras(h)
+}
+
+// fillURL sijoittaa kameran ja paikan osoitepohjaan. Polussa arvot koodataan polun osiksi ja
+// kyselyosassa kyselyparametreiksi, joten välilyönnistä tulee polussa %20 ja kyselyssä +.
+func fillURL(template, camera, seat string) string {
+	path, query := template, ""
+	if i := strings.IndexAny(template, "?#"); i >= 0 {
+		path, query = template[:i], template[i:]
+	}
+	return strings.NewReplacer("{camera}", url.PathEscape(camera), "{seat}", url.PathEscape(seat)).Replace(path) +
+		strings.NewReplacer("{camera}", url.QueryEscape(camera), "{seat}", url.QueryEscape(seat)).Replace(query)
+}
+
+// send lähettää kameran osoitteeseen pyynnön. Epäonnistunut pyyntö merkitsee lähdön alhaalla
+// olevaksi seuraavaan onnistuneeseen pyyntöön asti.
+func (h *httpOutput) send(template, camera string) {
+	if template == "" || camera == "" {
+		return
+	}
+	var seat string
+	if _, p, ok := store.Roster().ByCamera(camera); ok {
+		seat = p.Seat()
+	}
+	err := h.request(fillURL(template, camera, seat))
+
+	h.mu.Lock()
+	h.requestsSent++
+	if err != nil {
+		h.requestsFailed++
+		h.cameraErrors[camera] = err.Error()
+	} else {
+		delete(h.cameraErrors, camera)
+	}
+	h.mu.Unlock()
+
+	if err != nil {
+		log.Printf("Kameran %s komento HTTP-videolähdölle %s epäonnistui: %s", camera, h.address, err)
+		h.setHealth(outputDown, err)
+		return
+	}
+	h.setHealth(outputUp, nil)
+}
+
+// request lähettää pyynnön. Virheissä ei näytetä osoitetta, koska siinä voi olla API-avain.
+func (h *httpOutput) request(target string) error {
+	req, err := http.NewRequest(h.method, target, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := h.client.Do(req)
+	if urlErr, ok := err.(*url.Error); ok {
+		return fmt.Errorf("%s-pyyntö epäonnistui: %s", h.method, urlErr.Err)
+	} else if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s-pyyntö epäonnistui: HTTP %d", h.method, resp.StatusCode)
+	}
+	return nil
+}
+
+func (h *httpOutput) setHealth(state string, err error) {
+	h.mu.Lock()
+	changed := h.health.State != state
+	if changed {
+		h.health.Since = time.Now()
+	}
+	h.health.State = state
+	if err != nil {
+		h.health.LastError = err.Error()
+	}
+	h.mu.Unlock()
+
+	if changed {
+		hub.publish(eventObsServer, h.Health())
+	}
+}
+
+func (h *httpOutput) Health() outputStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	cameraErrors := make(map[string]string, len(h.cameraErrors))
+	for camera, err := range h.cameraErrors {
+		cameraErrors[camera] = err
+	}
+	return outputStatus{
+		Address:        h.address,
+		Kind:           outputHTTP,
+		outputHealth:   h.health,
+		CameraErrors:   cameraErrors,
+		RequestsSent:   h.requestsSent,
+		RequestsFailed: h.requestsFailed,
+	}
+}
@@ -0,0 +1,139 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestHTTPOutput vaihtaa kameroita HTTP-lähdön ja kuivaharjoituslähdön välillä. Molemmat
+// määritellään outputs-listassa.
+func TestHTTPOutput(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []string
+		status   = http.StatusOK
+	)
+	mixer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, r.Method+" "+r.URL.RequestURI())
+		w.WriteHeader(status)
+	}))
+	defer mixer.Close()
+	lastRequest := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(requests) == 0 {
+			return ""
+		}
+		return requests[len(requests)-1]
+	}
+
+	cq, err := DecodeJsonToJsonQ(strings.NewReader(`{"outputs": [
+		{"type": "http", "name": "mikseri", "method": "post", "teams": ["A"],
+		 "show_url": "` + mixer.URL + `/show?input={camera}&seat={seat}",
+		 "hide_url": "` + mixer.URL + `/hide?input={camera}"},
+		{"type": "dry-run", "name": "harjoitus", "teams": ["B"]}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	outs, err := loadOutputs(cq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mixerOutput, ok := outs[0].(*httpOutput)
+	if !ok {
+		t.Fatalf("ensimmäinen lähtö on %T, odotettiin HTTP-lähtöä", outs[0])
+	}
+	server, stop := startIntegration(t, outs...)
+	defer stop()
+
+	// Käynnistettäessä lähdön kamerat piilotetaan
+	if got := lastRequest(); got != "POST /hide?input=A5" {
+		t.Errorf("viimeisin pyyntö käynnistyksessä %q", got)
+	}
+
+	observe(t, server, "76561198293547781")
+	if got := lastRequest(); got != "POST /show?input=A1&seat=A1" {
+		t.Errorf("viimeisin pyyntö %q, odotettiin kameran A1 näyttämistä", got)
+	}
+
+	observe(t, server, "76561198293547772")
+	if got := lastRequest(); got != "POST /hide?input=A1" {
+		t.Errorf("viimeisin pyyntö %q, odotettiin kameran A1 piilottamista", got)
+	}
+	scenes := dryRunScenes()
+	if len(scenes) != 1 || scenes[0].Server != "harjoitus" {
+		t.Fatalf("virtuaaliset scenet %+v", scenes)
+	}
+	for _, c := range scenes[0].Cameras {
+		if c.Visible != (c.Camera == "B2") {
+			t.Errorf("kameran %s näkyvyys %v", c.Camera, c.Visible)
+		}
+	}
+
+	mu.Lock()
+	status = http.StatusInternalServerError
+	mu.Unlock()
+	observe(t, server, "76561198293547783")
+	s := mixerOutput.Health()
+	if s.State != outputDown || s.Kind != outputHTTP || s.Address != "mikseri" {
+		t.Errorf("HTTP-lähdön tila %s (%s, %s), odotettiin down", s.State, s.Kind, s.Address)
+	}
+	if err := s.CameraErrors["A3"]; !strings.Contains(err, "HTTP 500") {
+		t.Errorf("kameran A3 virhe %q", err)
+	}
+
+	mu.Lock()
+	status = http.StatusOK
+	mu.Unlock()
+	observe(t, server, "76561198293547784")
+	if s := mixerOutput.Health(); s.State != outputUp || s.CameraErrors["A4"] != "" {
+		t.Errorf("HTTP-lähdön tila %s, kameran A4 virhe %q", s.State, s.CameraErrors["A4"])
+	}
+}
+
+// TestHTTPOutputConfig tarkistaa outputs-listan virheelliset merkinnät. Virheilmoituksissa ei saa
+// näkyä salasanoja eikä osoitteiden API-avaimia.
+func TestHTTPOutputConfig(t *testing.T) {
+	for _, config := range []string{
+		`{"outputs": [{"type": "http", "teams": ["A"]}]}`,
+		`{"outputs": [{"type": "http", "show_url": "ftp://mikseri/{camera}?key=salainen", "teams": ["A"]}]}`,
+		`{"outputs": [{"type": "http", "show_url": "http://mikseri/{camera}?key=salainen", "method": "DELETE", "teams": ["A"]}]}`,
+		`{"outputs": [{"type": "obs", "address": "10.0.0.1", "password": "salainen", "teams": ["A"]}]}`,
+		`{"outputs": [{"type": "obs", "address": "10.0.0.1", "port": "4455", "protocol": "v6", "password": "salainen"}]}`,
+		`{"camera_servers": [{"address": "10.0.0.1", "port": "4455", "password": "salainen", "teams": "A"}]}`,
+		`{"outputs": [{"type": "http", "show_url": "http://mikseri/{camera}"}]}`,
+		`{"outputs": [{"type": "dry-run", "teams": ["A"]}]}`,
+		`{"outputs": [{"type": "atem", "teams": ["A"]}]}`,
+		`{"outputs": []}`,
+	} {
+		cq, err := DecodeJsonToJsonQ(strings.NewReader(config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = loadOutputs(cq)
+		if err == nil {
+			t.Errorf("konfiguraatio %s hyväksyttiin", config)
+		} else if strings.Contains(err.Error(), "salainen") {
+			t.Errorf("virheilmoitus paljastaa salaisuuden: %s", err)
+		}
+	}
+}
+
+// TestFillURL koodaa paikkamerkit polussa polun osiksi ja kyselyosassa kyselyparametreiksi
+func TestFillURL(t *testing.T) {
+	for _, c := range []struct{ template, want string }{
+		{"http://mikseri/kamera/{camera}/show", "http://mikseri/kamera/Kamera%20A&1/show"},
+		{"http://mikseri/show?input={camera}&seat={seat}", "http://mikseri/show?input=Kamera+A%261&seat=A1"},
+		{"http://mikseri/{seat}/{camera}?input={camera}", "http://mikseri/A1/Kamera%20A&1?input=Kamera+A%261"},
+	} {
+		if got := fillURL(c.template, "Kamera A&1", "A1"); got != c.want {
+			t.Errorf("osoitepohjasta %s tuli %s, odotettiin %s", c.template, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Käsiohjauksen tilat. Automaattitilassa kamera seuraa observerin valintaa, pakotetussa tilassa
+// lähetyksessä on tuottajan valitsema kamera ja lukitussa tilassa lukitushetkellä näkynyt kamera.
+const (
+	overrideAuto   = "auto"
+	overrideForced = "forced"
+	overrideLocked = "locked"
+)
+
+// overrideState kertoo käsiohjauksen tilan /state-rajapinnalle
+type overrideState struct {
+	Mode   string     `json:"mode"`
+	Player SteamID64  `json:"player,omitempty"`
+	Camera string     `json:"camera,omitempty"`
+	Since  *time.Time `json:"since,omitempty"`
+	// Observerin viimeisin valinta, joka tulee lähetykseen käsiohjauksen päättyessä
+	Observed SteamID64 `json:"observed,omitempty"`
+}
+
+// Force vie pelaajan kameran lähetykseen observerin valinnasta ja viiveistä välittämättä
+func (cs *cameraSwitcher) Force(playerSID SteamID64) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if cs.timer != nil {
+		cs.timer.Stop()
+		cs.timer = nil
+	}
+	cs.override = overrideForced
+	cs.overrideSince = time.Now()
+	if playerSID != cs.onAir {
+		cs.issue(playerSID, time.Time{})
+		cs.onAir = playerSID
+		cs.onAirSince = cs.overrideSince
+	}
+}
+
+// Lock pitää lähetyksessä olevan kameran, kunnes käsiohjaus vapautetaan
+func (cs *cameraSwitcher) Lock() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if cs.timer != nil {
+		cs.timer.Stop()
+		cs.timer = nil
+	}
+	if cs.override == overrideAuto {
+		cs.overrideSince = time.Now()
+	}
+	cs.override = overrideLocked
+}
+
+// Release palauttaa kameranvaihdon observerin valinnan mukaiseksi
+func (cs *cameraSwitcher) Release() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.override = overrideAuto
+	cs.overrideSince = time.Time{}
+	// Vapautuksen jälkeinen vaihto ei johdu GSI-paketista, joten sen viivettä ei mitata
+	cs.targetReceived = time.Time{}
+	cs.apply(time.Now())
+}
+
+func (cs *cameraSwitcher) overrideState() overrideState {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	state := overrideState{Mode: cs.override}
+	if cs.override != overrideAuto {
+		since := cs.overrideSince
+		state.Since = &since
+		state.Player = cs.onAir
+		state.Observed = cs.target
+		if p, ok := store.Roster().BySteamID(cs.onAir); ok {
+			state.Camera = p.Camera
+		}
+	}
+	return state
+}
+
+// ForceCamera vie kameran lähetykseen: POST /override/camera/{camera}
+func ForceCamera(w http.ResponseWriter, r *http.Request) {
+	camera := mux.Vars(r)["camera"]
+	id, p, ok := store.Roster().ByCamera(camera)
+	if !ok {
+		http.Error(w, "tuntematon kamera "+camera, http.StatusNotFound)
+		return
+	}
+	if store.CameraDisabled(camera) {
+		http.Error(w, "kamera "+camera+" on poistettu käytöstä", http.StatusConflict)
+		return
+	}
+	log.Printf("Käsiohjaus: kamera %s (%s) pakotettu lähetykseen", camera, p.PlayerName)
+	switcher.Force(id)
+	reportOverride(w)
+}
+
+// LockCamera lukitsee lähetyksessä olevan kameran: POST /override/lock
+func LockCamera(w http.ResponseWriter, r *http.Request) {
+	log.Println("Käsiohjaus: kamera lukittu")
+	switcher.Lock()
+	reportOverride(w)
+}
+
+// ReleaseCamera palauttaa kameranvaihdon observerille: POST /override/release
+func ReleaseCamera(w http.ResponseWriter, r *http.Request) {
+	log.Println("Käsiohjaus päättyi, kamera seuraa taas observeria")
+	switcher.Release()
+	reportOverride(w)
+}
+
+func reportOverride(w http.ResponseWriter) {
+	s, err := json.MarshalIndent(switcher.overrideState(), "", "    ")
+	if err != nil {
+		log.Println("Käsiohjauksen tilan JSON-käännös epäonnistui: ", err)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(s)
+}
@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const preflightConnectTimeout = 10 * time.Second
+
+// preflight tarkistaa videolähtöjen kamerat joukkuekonfiguraatiota vasten: jokaisen pelaajan
+// kameran pitää löytyä tasan yhdeltä lähdöltä, ja sen lähdön pitää olla kameran omistaja. OBS-palvelimilta
+// kysytään scenen lähteet, muiden lähtöjen kameroiksi oletetaan niille jaetut kamerat. Tulokset
+// tulostetaan taulukkona. Tiukassa tilassa mikä tahansa ongelma keskeyttää käynnistyksen.
+func preflight(strict bool) {
+	found := make(map[string][]videoOutput)
+	var unreachable []string
+
+	deadline := time.Now().Add(preflightConnectTimeout)
+	for _, o := range outputs {
+		if !waitUntilUp(o, time.Until(deadline)) {
+			unreachable = append(unreachable, o.name())
+			continue
+		}
+		var items []string
+		if lister, ok := o.(cameraLister); ok {
+			var err error
+			if items, err = lister.listCameras(); err != nil {
+				log.Printf("Kameroiden haku videolähdöltä %s epäonnistui: %s", o.name(), err)
+				unreachable = append(unreachable, o.name())
+				continue
+			}
+		} else {
+			switchMutex.Lock()
+			items = ownedCameras(o)
+			switchMutex.Unlock()
+		}
+		for _, item := range items {
+			found[item] = append(found[item], o)
+		}
+	}
+
+	switchMutex.Lock()
+	cameras := make(map[string]bool)
+	for _, camera := range store.Roster().Cameras() {
+		cameras[camera] = true
+	}
+	owners := make(map[string]videoOutput, len(cameraOwners))
+	for camera, s := range cameraOwners {
+		owners[camera] = s
+	}
+	switchMutex.Unlock()
+
+	var buf bytes.Buffer
+	tw := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "KAMERA\tLÄHDÖT\tTILA")
+	problems := 0
+
+	var names []string
+	for camera := range cameras {
+		names = append(names, camera)
+	}
+	sort.Strings(names)
+	for _, camera := range names {
+		servers := found[camera]
+		state := "ok"
+		switch {
+		case len(servers) == 0:
+			state = "puuttuu"
+		case len(servers) > 1:
+			state = "useammalla lähdöllä"
+		case owners[camera] != nil && owners[camera] != servers[0]:
+			state = "määritelty lähdölle " + owners[camera].name()
+		}
+		if state != "ok" {
+			problems++
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", camera, serverHosts(servers), state)
+	}
+
+	var unused []string
+	for item := range found {
+		if !cameras[item] {
+			unused = append(unused, item)
+		}
+	}
+	sort.Strings(unused)
+	for _, item := range unused {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", item, serverHosts(found[item]), "käyttämätön")
+	}
+	tw.Flush()
+	log.Printf("Videolähtöjen tarkistus:\n%s", buf.String())
+
+	if len(unreachable) > 0 {
+		log.Printf("Videolähtöjä %s ei voitu tarkistaa", strings.Join(unreachable, ", "))
+		problems += len(unreachable)
+	}
+	if problems > 0 && strict {
+		log.Fatalf("Videolähtöjen tarkistuksessa löytyi %d ongelmaa, käynnistys keskeytetään", problems)
+	}
+}
+
+func serverHosts(servers []videoOutput) string {
+	if len(servers) == 0 {
+		return "-"
+	}
+	hosts := make([]string, len(servers))
+	for i, s := range servers {
+		hosts[i] = s.name()
+	}
+	return strings.Join(hosts, ", ")
+}
@@ -0,0 +1,230 @@
+package internal
+
+import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	pushSendBuffer       = 64
+	pushWriteTimeout     = 2 * time.Second
+	pushPingInterval     = 15 * time.Second
+	gsiHeartbeatInterval = time.Second
+)
+
+// /ws-rajapinnan tapahtumatyypit
+const (
+	eventSnapshot       = "snapshot"
+	eventObservedPlayer = "observed_player"
+	eventCameraOnAir    = "camera_on_air"
+	eventRoster         = "roster"
+	eventObsServer      = "obs_server"
+	eventGSIHeartbeat   = "gsi_heartbeat"
+)
+
+type (
+	// pushEvent on /ws-asiakkaille lähetettävä viesti
+	pushEvent struct {
+		Type string      `json:"type"`
+		Time time.Time   `json:"time"`
+		Data interface{} `json:"data"`
+	}
+
+	// pushHub välittää tapahtumat kaikille /ws-asiakkaille. Tapahtuman julkaisu ei koskaan jää
+	// odottamaan hidasta asiakasta, vaan asiakas, jonka puskuri on täynnä, katkaistaan.
+	pushHub struct {
+		mu            sync.Mutex
+		clients       map[*pushClient]struct{}
+		lastHeartbeat time.Time
+	}
+
+	// pushClient on yksi /ws-yhteys. Yhteyteen kirjoittaa vain sen kirjoittajagoroutine.
+	pushClient struct {
+		ws   *websocket.Conn
+		send chan pushEvent
+	}
+
+	playerEvent struct {
+		SteamID    SteamID64 `json:"steamid"`
+		PlayerName string    `json:"player_name,omitempty"`
+		Camera     string    `json:"camera"`
+	}
+
+	heartbeatEvent struct {
+		Observer string `json:"observer"`
+		gsiStatus
+	}
+
+	// snapshotEvent kertoo uudelle asiakkaalle koko tilan, jota tapahtumat sen jälkeen päivittävät
+	snapshotEvent struct {
+		State         json.RawMessage            `json:"state"`
+		Players       map[SteamID64]playerStatus `json:"players"`
+		Observed      playerEvent                `json:"observed"`
+		OnAir         playerEvent                `json:"on_air"`
+		CameraServers []outputStatus             `json:"camera_servers"`
+		GSI           gsiStatus                  `json:"gsi"`
+	}
+)
+
+var (
+	hub = &pushHub{clients: make(map[*pushClient]struct{})}
+
+	wsUpgrader = websocket.Upgrader{
+		// Grafiikkaoverlayt avataan selaimessa mistä tahansa osoitteesta, kuten /players
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+)
+
+// publish lähettää tapahtuman kaikille asiakkaille. Voidaan kutsua lukkoja pitäen.
+func (h *pushHub) publish(eventType string, data interface{}) {
+	ev := pushEvent{Type: eventType, Time: time.Now(), Data: data}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.clients {
+		select {
+		case c.send <- ev:
+		default:
+			log.Printf("/ws-asiakas %s ei ehdi lukea tapahtumia, yhteys katkaistaan", c.ws.RemoteAddr())
+			delete(h.clients, c)
+			close(c.send)
+		}
+	}
+}
+
+func (h *pushHub) register(c *pushClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.clients[c] = struct{}{}
+}
+
+func (h *pushHub) unregister(c *pushClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.clients[c]; ok {
+		delete(h.clients, c)
+		close(c.send)
+	}
+}
+
+// heartbeat julkaisee GSI-sykkeen enintään kerran sekunnissa
+func (h *pushHub) heartbeat(observer string) {
+	h.mu.Lock()
+	now := time.Now()
+	due := now.Sub(h.lastHeartbeat) >= gsiHeartbeatInterval
+	if due {
+		h.lastHeartbeat = now
+	}
+	h.mu.Unlock()
+
+	if due {
+		h.publish(eventGSIHeartbeat, heartbeatEvent{Observer: observer, gsiStatus: packetStats.status()})
+	}
+}
+
+// ServePush avaa /ws-yhteyden. Ensimmäinen viesti on aina snapshot-tapahtuma.
+func ServePush(w http.ResponseWriter, r *http.Request) {
+	ws, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("/ws-yhteyden avaus osoitteesta %s epäonnistui: %s", r.RemoteAddr, err)
+		return
+	}
+	c := &pushClient{ws: ws, send: make(chan pushEvent, pushSendBuffer)}
+
+	// Rekisteröinnin ja snapshotin välissä julkaistut tapahtumat lähetetään snapshotin jälkeen.
+	// Ne sisältyvät jo snapshotiin, joten asiakkaan tila pysyy oikeana.
+	hub.register(c)
+	snapshot := pushEvent{Type: eventSnapshot, Time: time.Now(), Data: pushSnapshot()}
+	log.Printf("/ws-asiakas yhdisti osoitteesta %s", r.RemoteAddr)
+
+	go c.write(snapshot)
+	go c.read()
+}
+
+// write on asiakkaan kirjoittajagoroutine
+func (c *pushClient) write(snapshot pushEvent) {
+	ticker := time.NewTicker(pushPingInterval)
+	defer ticker.Stop()
+	defer c.ws.Close()
+
+	c.ws.SetWriteDeadline(time.Now().Add(pushWriteTimeout))
+	if err := c.ws.WriteJSON(snapshot); err != nil {
+		return
+	}
+	for {
+		var err error
+		select {
+		case ev, ok := <-c.send:
+			c.ws.SetWriteDeadline(time.Now().Add(pushWriteTimeout))
+			if !ok {
+				c.ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+				return
+			}
+			err = c.ws.WriteJSON(ev)
+		case <-ticker.C:
+			c.ws.SetWriteDeadline(time.Now().Add(pushWriteTimeout))
+			err = c.ws.WriteMessage(websocket.PingMessage, nil)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// read lukee asiakkaan viestit pois, jotta sulkeminen ja pong-viestit käsitellään. Asiakkaan
+// lähettämät viestit ohitetaan.
+func (c *pushClient) read() {
+	for {
+		if _, _, err := c.ws.ReadMessage(); err != nil {
+			hub.unregister(c)
+			return
+		}
+	}
+}
+
+func pushSnapshot() snapshotEvent {
+	state, err := store.TeamsJSON(switcher.overrideState(), dryRunScenes())
+	if err != nil {
+		log.Println("Joukkuestatuksen JSON-käännös epäonnistui: ", err)
+	}
+	switcher.mu.Lock()
+	observed := switcher.target
+	switcher.mu.Unlock()
+
+	return snapshotEvent{
+		State:         state,
+		Players:       playerStatuses(),
+		Observed:      observedPlayerEvent(observed),
+		OnAir:         onAirEvent(),
+		CameraServers: outputStatuses(),
+		GSI:           packetStats.status(),
+	}
+}
+
+func observedPlayerEvent(id SteamID64) playerEvent {
+	p, _ := store.Roster().BySteamID(id)
+	return playerEvent{SteamID: id, PlayerName: p.PlayerName, Camera: p.Camera}
+}
+
+// onAirEvent kertoo lähetyksessä olevan kameran. Kamera on tyhjä, jos kaikki kamerat on piilotettu.
+func onAirEvent() playerEvent {
+	id := store.CurrentPlayer()
+	p, _ := store.Roster().BySteamID(id)
+	ev := playerEvent{SteamID: id, PlayerName: p.PlayerName, Camera: p.Camera}
+	if store.CameraDisabled(p.Camera) {
+		ev.Camera = ""
+	}
+	return ev
+}
+
+func publishOnAir() {
+	hub.publish(eventCameraOnAir, onAirEvent())
+}
+
+func publishRoster() {
+	hub.publish(eventRoster, playerStatuses())
+}
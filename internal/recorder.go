@@ -0,0 +1,85 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+type (
+	// gsiRecord on nauhoitustiedoston yksi rivi
+	gsiRecord struct {
+		Received time.Time       `json:"received"`
+		Observer string          `json:"observer"`
+		Packet   json.RawMessage `json:"packet,omitempty"`
+		// Raw on paketti sellaisenaan, jos se ei ole kelvollista JSONia
+		Raw string `json:"raw,omitempty"`
+		// Rejected on hylätyn paketin hylkäyssyy, hyväksytyillä paketeilla tyhjä
+		Rejected string `json:"rejected,omitempty"`
+	}
+
+	// gsiRecorder kirjoittaa GSI-paketit NDJSON-tiedostoon, rivi per paketti
+	gsiRecorder struct {
+		mu sync.Mutex
+		w  *bufio.Writer
+	}
+)
+
+// recorder on käytössä vain -record -vivulla, muuten record ei tee mitään
+var recorder = &gsiRecorder{}
+
+// open avaa nauhoitustiedoston. Olemassa olevan tiedoston perään jatketaan.
+func (rec *gsiRecorder) open(filename string) error {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("GSI-nauhoitustiedoston %s avaus epäonnistui: %s", filename, err)
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.w = bufio.NewWriter(f)
+	return nil
+}
+
+// record kirjoittaa paketin tiedostoon. Hylätyt paketit nauhoitetaan hylkäyssyineen, jotta
+// virhetilanteet voi toistaa. CS:GO lähettää paketit sisennettyinä, joten ne tiivistetään yhdelle
+// riville.
+func (rec *gsiRecorder) record(received time.Time, observer string, raw []byte, rejected string) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.w == nil {
+		return
+	}
+
+	r := gsiRecord{Received: received, Observer: observer, Rejected: rejected}
+	var packet bytes.Buffer
+	if err := json.Compact(&packet, raw); err != nil {
+		r.Raw = string(raw)
+	} else {
+		r.Packet = packet.Bytes()
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		log.Printf("GSI-paketin nauhoitus epäonnistui: %s", err)
+		return
+	}
+	rec.w.Write(line)
+	rec.w.WriteByte('\n')
+	// Tiedosto pidetään ajan tasalla, jotta nauhoitus säilyy vaikka PKM kaatuisi kesken ottelun
+	if err = rec.w.Flush(); err != nil {
+		log.Printf("GSI-paketin nauhoitus epäonnistui: %s", err)
+	}
+}
+
+// body palauttaa nauhoitetun paketin sellaisena kuin se vastaanotettiin
+func (r *gsiRecord) body() []byte {
+	if r.Packet != nil {
+		return r.Packet
+	}
+	return []byte(r.Raw)
+}
@@ -0,0 +1,247 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/jmoiron/jsonq"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const configPollInterval = time.Second
+
+type (
+	// configFiles on käynnistyksessä annetut konfiguraatiotiedostot, joita seurataan muutosten varalta
+	configFiles struct {
+		pkm   string
+		teamA string
+		teamB string
+	}
+
+	// pkmConfig on kokonaan luettu ja tarkistettu konfiguraatio, joka voidaan ottaa käyttöön kerralla
+	pkmConfig struct {
+		cq         *jsonq.JsonQuery
+		transition transitionConfig
+		settle     time.Duration
+		minHold    time.Duration
+		gsiTokens  map[string]string
+		control    string
+		roster     *Roster
+		outputs    []videoOutput
+	}
+
+	reloadResult struct {
+		Reloaded bool   `json:"reloaded"`
+		Players  int    `json:"players,omitempty"`
+		Error    string `json:"error,omitempty"`
+	}
+)
+
+var (
+	activeConfigFiles configFiles
+	// reloadMutex estää kahta uudelleenlatausta ajamasta päällekkäin
+	reloadMutex sync.Mutex
+)
+
+// loadConfig lukee ja tarkistaa kaikki konfiguraatiotiedostot muuttamatta käytössä olevaa tilaa
+func loadConfig(files configFiles) (*pkmConfig, error) {
+	var err error
+	c := &pkmConfig{}
+
+	if c.cq, err = LoadJsonFile(files.pkm); err != nil {
+		return nil, err
+	}
+	naming, err := loadCameraNaming(c.cq)
+	if err != nil {
+		return nil, fmt.Errorf("Kameroiden nimeämisasetusten lukeminen epäonnistui: %s", err)
+	}
+	if c.transition, err = loadTransition(c.cq); err != nil {
+		return nil, fmt.Errorf("Siirtymäasetusten lukeminen epäonnistui: %s", err)
+	}
+	if c.settle, c.minHold, err = loadSwitching(c.cq); err != nil {
+		return nil, fmt.Errorf("Kameranvaihdon asetusten lukeminen epäonnistui: %s", err)
+	}
+	if c.gsiTokens, err = loadGSITokens(c.cq); err != nil {
+		return nil, err
+	}
+	if c.control, err = loadControlToken(c.cq); err != nil {
+		return nil, err
+	}
+	if c.outputs, err = loadOutputs(c.cq); err != nil {
+		return nil, err
+	}
+	if c.roster, err = loadRoster(files.teamA, files.teamB, naming); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload lukee konfiguraation uudelleen ja ottaa sen käyttöön vasta kun kaikki tiedostot on
+// todettu kelvollisiksi. Virheellinen konfiguraatio ei muuta mitään. Uudelleenlatauksen jälkeen
+// lähetyksessä olevan pelaajan kamera palautetaan uuden konfiguraation mukaiseksi.
+//
+// Videolähtöjä ja PKM:n kuunteluosoitetta ei vaihdeta lennosta, niiden muutokset tulevat
+// voimaan vasta uudelleenkäynnistyksessä.
+func Reload() (*Roster, error) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	c, err := loadConfig(activeConfigFiles)
+	if err != nil {
+		return nil, err
+	}
+	if !sameOutputs(c.outputs, outputs) {
+		log.Println("camera_servers- ja outputs-asetusten muutokset tulevat voimaan vasta PKM:n uudelleenkäynnistyksessä")
+	}
+	if configuredAddress(c.cq) != configuredAddress(CQ) {
+		log.Println("PKM:n osoitteen muutos tulee voimaan vasta PKM:n uudelleenkäynnistyksessä")
+	}
+
+	// Kameranvaihdot odottavat vaihdon ajan, joten yksikään vaihto ei näe puoliksi vaihdettua konfiguraatiota
+	switcher.mu.Lock()
+	switchMutex.Lock()
+
+	owners, err := cameraOwnersFor(c.roster, outputs, cameraOwners)
+	if err != nil {
+		switchMutex.Unlock()
+		switcher.mu.Unlock()
+		return nil, fmt.Errorf("Kameroiden jako videolähdöille epäonnistui: %s", err)
+	}
+
+	var previousCamera string
+	if p, ok := store.Roster().BySteamID(store.CurrentPlayer()); ok {
+		previousCamera = p.Camera
+	}
+	previousOwner := cameraOwners[previousCamera]
+
+	CQ = c.cq
+	transition = c.transition
+	switcher.setDelays(c.settle, c.minHold)
+	store.SetGSITokens(c.gsiTokens)
+	store.SetControlToken(c.control)
+	store.SetRoster(c.roster)
+	cameraOwners = owners
+
+	var currentCamera string
+	if p, ok := c.roster.BySteamID(store.CurrentPlayer()); ok {
+		currentCamera = p.Camera
+	}
+	if previousCamera != "" && previousCamera != currentCamera && previousOwner != nil {
+		// Kamera on voinut poistua rosterista, jolloin resync ei enää piilota sitä
+		previousOwner.HideCamera(previousCamera)
+	}
+	if _, ok := c.roster.BySteamID(switcher.target); ok && store.CurrentPlayer() == unknownPlayer {
+		// Observoitava pelaaja oli tuntematon, mutta korjattu konfiguraatio tuntee hänet. Vaihtaja
+		// luulee pelaajan jo olevan lähetyksessä, joten vaihto annetaan uudelleen.
+		switcher.onAir = ""
+		switcher.targetReceived = time.Time{}
+		switcher.apply(time.Now())
+	}
+
+	switchMutex.Unlock()
+	switcher.mu.Unlock()
+	publishRoster()
+	publishOnAir()
+
+	for _, o := range outputs {
+		if o.Health().State != outputUp {
+			// Lähtö palauttaa kamerat itse yhteyden avauduttua
+			continue
+		}
+		o.restore()
+	}
+	log.Printf("Konfiguraatio ladattu uudelleen, pelaajia %d", c.roster.Len())
+	return c.roster, nil
+}
+
+func configuredAddress(cq *jsonq.JsonQuery) string {
+	address, _ := cq.String("pkm", "address")
+	port, _ := cq.String("pkm", "port")
+	return address + ":" + port
+}
+
+// reloadAndLog lataa konfiguraation uudelleen valvontagoroutineista. Kuten HTTP-pyynnöissä
+// (recoverPanics), paniikki ei saa kaataa PKM:ää kesken ottelun.
+func reloadAndLog(reason string) {
+	log.Printf("Konfiguraation uudelleenlataus: %s", reason)
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("Konfiguraation uudelleenlataus kaatui: %v\n%s", p, debug.Stack())
+		}
+	}()
+	if _, err := Reload(); err != nil {
+		log.Printf("Konfiguraation uudelleenlataus epäonnistui, vanha konfiguraatio pysyy käytössä: %s", err)
+	}
+}
+
+// watchConfigFiles seuraa konfiguraatiotiedostojen muokkausaikoja ja lataa konfiguraation
+// uudelleen, kun jokin tiedostoista muuttuu
+func watchConfigFiles(files configFiles) {
+	type fileVersion struct {
+		modTime time.Time
+		size    int64
+	}
+	version := func(filename string) fileVersion {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return fileVersion{}
+		}
+		return fileVersion{info.ModTime(), info.Size()}
+	}
+
+	names := []string{files.pkm, files.teamA, files.teamB}
+	seen := make(map[string]fileVersion)
+	for _, name := range names {
+		seen[name] = version(name)
+	}
+	for range time.Tick(configPollInterval) {
+		var changed []string
+		for _, name := range names {
+			if v := version(name); v != seen[name] {
+				seen[name] = v
+				changed = append(changed, name)
+			}
+		}
+		if len(changed) > 0 {
+			reloadAndLog(fmt.Sprintf("tiedosto muuttui %v", changed))
+		}
+	}
+}
+
+// watchReloadSignal lataa konfiguraation uudelleen SIGHUP-signaalista
+func watchReloadSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		reloadAndLog("SIGHUP")
+	}
+}
+
+// ReloadConfig lataa konfiguraation uudelleen. Epäonnistuessa vastaus on 422 ja virheilmoitus.
+func ReloadConfig(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Konfiguraation uudelleenlataus: HTTP-pyyntö osoitteesta %s", r.RemoteAddr)
+
+	result := reloadResult{Reloaded: true}
+	status := http.StatusOK
+	roster, err := Reload()
+	if err != nil {
+		log.Printf("Konfiguraation uudelleenlataus epäonnistui, vanha konfiguraatio pysyy käytössä: %s", err)
+		result = reloadResult{Error: err.Error()}
+		status = http.StatusUnprocessableEntity
+	} else {
+		result.Players = roster.Len()
+	}
+
+	s, err := json.MarshalIndent(result, "", "    ")
+	if err != nil {
+		log.Println("Uudelleenlatauksen tuloksen JSON-käännös epäonnistui: ", err)
+	}
+	w.WriteHeader(status)
+	w.Write(s)
+}
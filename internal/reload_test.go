@@ -0,0 +1,184 @@
+package internal
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testPkmConfig = `{
+	"pkm": {"address": "127.0.0.1", "port": "1999"},
+	"camera_servers": [
+		{"address": "127.0.0.1", "port": "4444", "teams": ["A"]},
+		{"address": "127.0.0.1", "port": "4455", "teams": ["B"]}
+	]
+}`
+
+func writeFile(t *testing.T, filename, content string) {
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestReload tarkistaa, että kelvollinen konfiguraatio otetaan käyttöön ja virheellinen hylätään
+// kokonaan niin, että vanha konfiguraatio pysyy voimassa
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pkm-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := configFiles{
+		pkm:   filepath.Join(dir, "pkm.json"),
+		teamA: filepath.Join(dir, "a.json"),
+		teamB: filepath.Join(dir, "b.json"),
+	}
+	writeFile(t, files.pkm, testPkmConfig)
+	writeFile(t, files.teamA, `{"players": {"76561198293547781": {"player_name": "A1", "place": 1}}}`)
+	writeFile(t, files.teamB, `{"players": {"76561198293547771": {"player_name": "B1", "place": 1}}}`)
+
+	activeConfigFiles = files
+	store = newStateStore()
+	if CQ, err = LoadJsonFile(files.pkm); err != nil {
+		t.Fatal(err)
+	}
+	if outputs, err = loadOutputs(CQ); err != nil {
+		t.Fatal(err)
+	}
+	cameraOwners = make(map[string]videoOutput)
+
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+	reload := func() int {
+		resp, err := http.Post(server.URL+"/reload", "application/json", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := reload(); status != http.StatusOK {
+		t.Fatalf("uudelleenlatauksen vastaus %d, odotettiin 200", status)
+	}
+	if _, p, ok := store.Roster().ByCamera("A1"); !ok || p.PlayerName != "A1" {
+		t.Fatalf("kameraa A1 ei löytynyt uudelleenlatauksen jälkeen")
+	}
+	if cameraOwners["B1"] != outputs[1] {
+		t.Errorf("kameran B1 omistaja on %v, odotettiin %s", cameraOwners["B1"], outputs[1].name())
+	}
+
+	// Kaksi pelaajaa samalla paikalla
+	writeFile(t, files.teamA, `{"players": {
+		"76561198293547782": {"player_name": "A2", "place": 2},
+		"76561198293547783": {"player_name": "A3", "place": 2}
+	}}`)
+	if status := reload(); status != http.StatusUnprocessableEntity {
+		t.Fatalf("virheellisen konfiguraation vastaus %d, odotettiin 422", status)
+	}
+	if _, p, ok := store.Roster().ByCamera("A1"); !ok || p.PlayerName != "A1" {
+		t.Errorf("virheellinen konfiguraatio korvasi käytössä olevan rosterin")
+	}
+
+	// Virheellinen SteamID hylätään ilman paniikkia. Reload kutsutaan suoraan kuten tiedostojen
+	// ja SIGHUP:n valvonnassa, joissa recoverPanics ei suojaa.
+	for _, id := range []string{"STEAM_0:1", "STEAM_0:1:x", "[U:1]", "U:1:"} {
+		writeFile(t, files.teamA, `{"players": {"`+id+`": {"player_name": "A2", "place": 2}}}`)
+		if _, err := Reload(); err == nil {
+			t.Errorf("SteamID %s hyväksyttiin", id)
+		}
+	}
+	if _, p, ok := store.Roster().ByCamera("A1"); !ok || p.PlayerName != "A1" {
+		t.Errorf("virheellinen SteamID korvasi käytössä olevan rosterin")
+	}
+
+	writeFile(t, files.teamA, `{"players": {"76561198293547782": {"player_name": "A2", "place": 2}}}`)
+	if status := reload(); status != http.StatusOK {
+		t.Fatalf("uudelleenlatauksen vastaus %d, odotettiin 200", status)
+	}
+	if _, _, ok := store.Roster().ByCamera("A1"); ok {
+		t.Errorf("kamera A1 jäi rosteriin")
+	}
+	if _, p, ok := store.Roster().BySeat("A2"); !ok || p.PlayerName != "A2" {
+		t.Errorf("paikalta A2 ei löytynyt pelaajaa")
+	}
+}
+
+// TestReloadUnknownPlayer korjaa kesken ottelun observoitavan pelaajan virheellisen SteamID:n.
+// Uudelleenlatauksen jälkeen pelaajan kameran pitää tulla lähetykseen ilman uutta pelaajavalintaa.
+func TestReloadUnknownPlayer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pkm-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := configFiles{
+		pkm:   filepath.Join(dir, "pkm.json"),
+		teamA: filepath.Join(dir, "a.json"),
+		teamB: filepath.Join(dir, "b.json"),
+	}
+	writeFile(t, files.pkm, `{"outputs": [{"type": "dry-run", "name": "harjoitus", "teams": ["A", "B"]}]}`)
+	// A1:n SteamID:ssä on kirjoitusvirhe
+	writeFile(t, files.teamA, `{"players": {"76561198293547789": {"player_name": "A1", "place": 1}}}`)
+	writeFile(t, files.teamB, `{"players": {"76561198293547771": {"player_name": "B1", "place": 1}}}`)
+
+	activeConfigFiles = files
+	store = newStateStore()
+	switcher = &cameraSwitcher{override: overrideAuto}
+	transition = transitionConfig{mode: transitionCut}
+	if CQ, err = LoadJsonFile(files.pkm); err != nil {
+		t.Fatal(err)
+	}
+	if outputs, err = loadOutputs(CQ); err != nil {
+		t.Fatal(err)
+	}
+	cameraOwners = make(map[string]videoOutput)
+	if _, err = Reload(); err != nil {
+		t.Fatal(err)
+	}
+	for _, o := range outputs {
+		o.start()
+	}
+	defer func() {
+		for _, o := range outputs {
+			o.Stop()
+		}
+		outputs = nil
+		cameraOwners = make(map[string]videoOutput)
+	}()
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+
+	a1Visible := func() bool {
+		for _, c := range dryRunScenes()[0].Cameras {
+			if c.Camera == "A1" {
+				return c.Visible
+			}
+		}
+		return false
+	}
+
+	observe(t, server, "76561198293547781")
+	if current := store.CurrentPlayer(); current != unknownPlayer {
+		t.Fatalf("lähetyksessä %s, odotettiin tuntematonta pelaajaa", current)
+	}
+
+	writeFile(t, files.teamA, `{"players": {"76561198293547781": {"player_name": "A1", "place": 1}}}`)
+	if _, err = Reload(); err != nil {
+		t.Fatal(err)
+	}
+	waitSwitched(t)
+	if current := store.CurrentPlayer(); current != "76561198293547781" || !a1Visible() {
+		t.Errorf("uudelleenlatauksen jälkeen lähetyksessä %s, A1 näkyvissä %v", current, a1Visible())
+	}
+
+	observe(t, server, "76561198293547781")
+	if current := store.CurrentPlayer(); current != "76561198293547781" || !a1Visible() {
+		t.Errorf("seuraavan paketin jälkeen lähetyksessä %s, A1 näkyvissä %v", current, a1Visible())
+	}
+}
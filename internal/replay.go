@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/pikayem/pkm/internal/gsi"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// replayMaxLine on nauhoitusrivin enimmäiskoko. Koko ottelun allplayers-tiedot mahtuvat reilusti.
+const replayMaxLine = 4 << 20
+
+// Replay toistaa -record -vivulla tehdyn nauhoituksen samalla käsittelyllä kuin observerin paketit:
+//
+//	pkm replay [-speed 2] [-conf pkm.json -A team2.json -B team1.json] nauhoitus.ndjson
+//
+// Konfiguraatio ja OBS-yhteydet avataan kuten palvelinta käynnistettäessä, ja rajapinnat ovat
+// käytössä toiston ajan, jos PKM:n portti on vapaa.
+func Replay(args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	speed := flags.Float64("speed", 1, "toistonopeus, 1 = nauhoituksen tahdissa, 2 = kaksinkertaisella nopeudella, 0 = ilman taukoja")
+	setup(flags, args)
+	if flags.NArg() != 1 {
+		log.Fatal("Käyttö: pkm replay [vivut] nauhoitus.ndjson")
+	}
+	if *speed < 0 {
+		log.Fatal("Toistonopeus ei voi olla negatiivinen")
+	}
+
+	go func() {
+		listenAddress := listenAddress()
+		log.Print("PKM:n rajapinnat toiston ajan osoitteessa: " + listenAddress)
+		if err := http.ListenAndServe(listenAddress, newRouter()); err != nil {
+			log.Printf("PKM:n rajapinnat eivät ole käytössä toiston aikana: %s", err)
+		}
+	}()
+
+	count, err := replayFile(flags.Arg(0), *speed)
+	if err != nil {
+		log.Fatalf("Nauhoituksen %s toisto keskeytyi %d paketin jälkeen: %s", flags.Arg(0), count, err)
+	}
+
+	// Viimeinen valinta voi odottaa vielä switching-viiveitä
+	switcher.mu.Lock()
+	pending := switcher.settle + switcher.minHold
+	switcher.mu.Unlock()
+	time.Sleep(pending)
+	switcher.waitIdle(obsRequestTimeout + transition.duration)
+	log.Printf("Nauhoitus %s toistettu, paketteja %d", flags.Arg(0), count)
+}
+
+// replayFile syöttää nauhoituksen paketit processGameStatus:lle pakettien vastaanottoaikojen
+// välein speed-kertoimella nopeutettuna. Nopeudella 0 paketit syötetään ilman taukoja. Virheellisinä
+// hylätyt paketit tarkistetaan uudelleen, jotta GSI-käsittelyn korjauksia voi kokeilla niillä.
+func replayFile(filename string, speed float64) (int, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, fmt.Errorf("nauhoituksen avaus epäonnistui: %s", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), replayMaxLine)
+	var previous time.Time
+	count, lineNo := 0, 0
+	for scanner.Scan() {
+		lineNo++
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var rec gsiRecord
+		if err = json.Unmarshal(line, &rec); err != nil {
+			return count, fmt.Errorf("rivi %d on virheellinen: %s", lineNo, err)
+		}
+
+		if speed > 0 && !previous.IsZero() {
+			if wait := rec.Received.Sub(previous); wait > 0 {
+				time.Sleep(time.Duration(float64(wait) / speed))
+			}
+		}
+		previous = rec.Received
+
+		packetStats.receive()
+		if rec.Rejected == rejectUnauthorized {
+			// Tokenit poistetaan nauhoituksesta, joten tarkistusta ei voi toistaa
+			log.Printf("Nauhoituksen rivin %d GSI-paketti hylättiin nauhoitettaessa: %s", lineNo, rec.Rejected)
+			packetStats.reject(rec.Rejected)
+			continue
+		}
+		data, err := gsi.Decode(bytes.NewReader(rec.body()))
+		if err != nil {
+			log.Printf("Nauhoituksen rivin %d GSI-paketti on virheellinen: %s", lineNo, err)
+			packetStats.reject(rejectMalformed)
+			continue
+		}
+		log.Printf("Toistetaan GSI-paketti observerilta %s (nauhoitettu %s)", rec.Observer, rec.Received.Format(time.RFC3339Nano))
+		processGameStatus(data, rec.body(), rec.Observer, time.Now())
+		count++
+	}
+	return count, scanner.Err()
+}
@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestRecordAndReplay nauhoittaa observerin paketit ja toistaa ne tyhjään tilaan. Toiston jälkeen
+// tilan pitää olla sama kuin nauhoituksen lopussa.
+func TestRecordAndReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pkm-replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	recording := filepath.Join(dir, "gsi.ndjson")
+
+	store = newStateStore()
+	store.SetRoster(testRoster(t))
+	outputs = nil
+	cameraOwners = make(map[string]videoOutput)
+	recorder = &gsiRecorder{}
+	defer func() { recorder = &gsiRecorder{} }()
+	if err = recorder.open(recording); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+	observed := []string{"76561198293547781", "76561198293547772", "76561198293547775"}
+	for i, sid := range observed {
+		resp, err := http.Post(server.URL+"/", "application/json", strings.NewReader(gsiPacket(sid, i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	// Virheellinen paketti nauhoitetaan hylkäyssyineen
+	resp, err := http.Post(server.URL+"/", "application/json", strings.NewReader("{"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	// Väärällä tokenilla hylätty paketti nauhoitetaan ilman tokenia
+	store.SetGSITokens(map[string]string{"salainen": "observer-1"})
+	unauthorized := strings.Replace(gsiPacket(observed[0], 0), `"player":`, `"auth": {"token": "väärä-token"}, "player":`, 1)
+	if resp, err = http.Post(server.URL+"/", "application/json", strings.NewReader(unauthorized)); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	store.SetGSITokens(nil)
+	waitSwitched(t)
+
+	recorded := store.LastGSIJSON()
+	recordedPlayer := store.CurrentPlayer()
+
+	store = newStateStore()
+	store.SetRoster(testRoster(t))
+	lines, err := ioutil.ReadFile(recording)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(lines, []byte(`"raw":"{","rejected":"malformed"`)) {
+		t.Errorf("virheellistä pakettia ei nauhoitettu:\n%s", lines)
+	}
+	if !bytes.Contains(lines, []byte(`"rejected":"unauthorized"`)) || bytes.Contains(lines, []byte("väärä-token")) {
+		t.Errorf("hylätty paketti puuttuu tai token nauhoitettiin:\n%s", lines)
+	}
+
+	recorder = &gsiRecorder{}
+	malformed := packetStats.status().Rejected[rejectMalformed]
+	count, err := replayFile(recording, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitSwitched(t)
+	if count != len(observed) {
+		t.Errorf("toistettiin %d pakettia, odotettiin %d", count, len(observed))
+	}
+	if n := packetStats.status().Rejected[rejectMalformed] - malformed; n != 1 {
+		t.Errorf("toistossa hylättiin %d virheellistä pakettia, odotettiin 1", n)
+	}
+	if store.CurrentPlayer() != recordedPlayer {
+		t.Errorf("toiston jälkeen lähetyksessä %s, odotettiin %s", store.CurrentPlayer(), recordedPlayer)
+	}
+	var want bytes.Buffer
+	if err = json.Compact(&want, recorded); err != nil {
+		t.Fatal(err)
+	}
+	if got := store.LastGSIJSON(); !bytes.Equal(got, want.Bytes()) {
+		t.Errorf("toiston viimeisin paketti\n%s\nodotettiin\n%s", got, want.Bytes())
+	}
+}
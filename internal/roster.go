@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+type (
+	// SteamID64 on pelaajan tunnus yhdenmukaistettuna SteamID64-muotoon, esim. "76561198293547781"
+	SteamID64 string
+
+	// Roster on joukkuetiedostoista koottu pelaajaluettelo, josta pelaajan voi hakea SteamID:n,
+	// kameran tai istumapaikan perusteella. Valmista rosteria ei muokata, joten sitä voi lukea
+	// useasta goroutinesta yhtä aikaa.
+	Roster struct {
+		players  map[SteamID64]Player
+		byCamera map[string]SteamID64
+		bySeat   map[string]SteamID64
+	}
+)
+
+// unknownPlayer on lähetyksessä olevan pelaajan tunnus silloin, kun observoitavaa pelaajaa ei löydy rosterista
+const unknownPlayer SteamID64 = "0"
+
+func NewRoster() *Roster {
+	return &Roster{
+		players:  make(map[SteamID64]Player),
+		byCamera: make(map[string]SteamID64),
+		bySeat:   make(map[string]SteamID64),
+	}
+}
+
+// Add lisää pelaajan rosteriin. Samaa SteamID:tä, istumapaikkaa tai kameraa ei voi olla kahdella pelaajalla.
+func (r *Roster) Add(id SteamID64, p Player) error {
+	if other, ok := r.players[id]; ok {
+		return fmt.Errorf("SteamID %s on sekä pelaajalla %s että %s", id, other.PlayerName, p.PlayerName)
+	}
+	if seat := p.Seat(); seat != "" {
+		if other, ok := r.bySeat[seat]; ok {
+			return fmt.Errorf("paikalla %s on sekä pelaaja %s että %s", seat, r.players[other].PlayerName, p.PlayerName)
+		}
+		r.bySeat[seat] = id
+	}
+	if p.Camera != "" {
+		if other, ok := r.byCamera[p.Camera]; ok {
+			return fmt.Errorf("kamera %s on sekä pelaajalla %s että %s", p.Camera, r.players[other].PlayerName, p.PlayerName)
+		}
+		r.byCamera[p.Camera] = id
+	}
+	r.players[id] = p
+	return nil
+}
+
+func (r *Roster) BySteamID(id SteamID64) (Player, bool) {
+	p, ok := r.players[id]
+	return p, ok
+}
+
+func (r *Roster) ByCamera(camera string) (SteamID64, Player, bool) {
+	id, ok := r.byCamera[camera]
+	return id, r.players[id], ok
+}
+
+// BySeat hakee pelaajan istumapaikalla, joka on joukkueen kirjain ja paikka, esim. "B3"
+func (r *Roster) BySeat(seat string) (SteamID64, Player, bool) {
+	id, ok := r.bySeat[seat]
+	return id, r.players[id], ok
+}
+
+// Each käy läpi kaikki pelaajat
+func (r *Roster) Each(fn func(id SteamID64, p Player)) {
+	for id, p := range r.players {
+		fn(id, p)
+	}
+}
+
+// Cameras palauttaa rosterin kamerat aakkosjärjestyksessä
+func (r *Roster) Cameras() []string {
+	cameras := make([]string, 0, len(r.byCamera))
+	for camera := range r.byCamera {
+		cameras = append(cameras, camera)
+	}
+	sort.Strings(cameras)
+	return cameras
+}
+
+func (r *Roster) Len() int {
+	return len(r.players)
+}
+
+// Seat palauttaa pelaajan istumapaikan, esim. "A1". Paikalla 0 olevalla pelaajalla ei ole istumapaikkaa.
+func (p Player) Seat() string {
+	if p.Place == 0 {
+		return ""
+	}
+	return p.Team + strconv.Itoa(p.Place)
+}
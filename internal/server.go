@@ -2,57 +2,128 @@ package internal
 
 import (
 	"bytes"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/jmoiron/jsonq"
+	"github.com/pikayem/pkm/internal/gsi"
 	"io/ioutil"
 	"log"
 	"net/http"
-)
-
-var (
-	teams map[string]map[string]Player
-	lastGSIJSON []byte
+	"os"
+	"runtime/debug"
+	"time"
 )
 
 func Run() {
-	setup()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "replay":
+			Replay(os.Args[2:])
+			return
+		case "simulate":
+			Simulate(os.Args[2:])
+			return
+		}
+	}
+
+	setup(flag.CommandLine, os.Args[1:])
+	go watchConfigFiles(activeConfigFiles)
+	go watchReloadSignal()
 
 	listenAddress := listenAddress()
 	log.Print("PKM palvelin käynnistyy osoitteessa: " + listenAddress)
 
+	log.Fatal(http.ListenAndServe(listenAddress, newRouter()))
+}
+
+func newRouter() *mux.Router {
 	router := mux.NewRouter()
+	router.Use(recoverPanics)
 
 	router.HandleFunc("/", ReceiveGameStatus)
 	router.HandleFunc("/state", ReportGameState)
 	router.HandleFunc("/players", ReportConfPlayers).Methods("GET", "OPTIONS")
 	router.HandleFunc("/lastgsijson", ReportLastGSIJSON)
+	router.HandleFunc("/servers", ReportCameraServers)
+	router.HandleFunc("/status", ReportStatus)
+	router.HandleFunc("/ws", ServePush)
+	router.HandleFunc("/dashboard", ServeDashboard).Methods("GET")
+	router.HandleFunc("/metrics", ReportMetrics).Methods("GET")
+	router.Handle("/reload", requireControl(ReloadConfig)).Methods("POST")
+	router.Handle("/cameras/{camera}/{action:disable|enable}", requireControl(SetCameraEnabled)).Methods("POST")
+	router.Handle("/seats/{seat}/{action:disable|enable}", requireControl(SetSeatEnabled)).Methods("POST")
+	router.Handle("/override/camera/{camera}", requireControl(ForceCamera)).Methods("POST")
+	router.Handle("/override/lock", requireControl(LockCamera)).Methods("POST")
+	router.Handle("/override/release", requireControl(ReleaseCamera)).Methods("POST")
 	//http.Handle("/", router)
 
-	log.Fatal(http.ListenAndServe(listenAddress, router))
+	return router
 }
 
 // ReceiveGameStatus käsittelee CS:GO observerin lähettämän pelidatapaketin
 func ReceiveGameStatus(w http.ResponseWriter, r *http.Request) {
+	received := time.Now()
+	packetStats.receive()
 	if r.Method != "POST" {
+		packetStats.reject(rejectMethod)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	raw, err := getRawPost(r)
+	if err != nil {
+		log.Printf("GSI-paketin lukeminen osoitteesta %s epäonnistui: %s", r.RemoteAddr, err)
+		packetStats.reject(rejectReadError)
+		recorder.record(received, r.RemoteAddr, raw, rejectReadError)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	data, err := gsi.Decode(bytes.NewReader(raw))
+	if err != nil {
+		log.Printf("Virheellinen GSI-paketti osoitteesta %s: %s", r.RemoteAddr, err)
+		packetStats.reject(rejectMalformed)
+		recorder.record(received, r.RemoteAddr, raw, rejectMalformed)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	var data *jsonq.JsonQuery
-	raw := getRawPost(r)
-	lastGSIJSON = raw
-	data = DecodeJsonToJsonQ(bytes.NewReader(raw))
 
-	_ = updateGameState(data)
-	_ = updateObserverState(data)
+	observer, ok := authenticateObserver(data)
+	if !ok {
+		log.Printf("GSI-paketti osoitteesta %s hylättiin, auth-token puuttuu tai on virheellinen", r.RemoteAddr)
+		packetStats.reject(rejectUnauthorized)
+		// Väärääkään tokenia ei nauhoiteta, se voi olla toisen observerin oikea token
+		recorder.record(received, r.RemoteAddr, withoutAuth(raw), rejectUnauthorized)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	log.Printf("GSI-paketti observerilta %s (%s)", observer, r.RemoteAddr)
+	processGameStatus(data, raw, observer, received)
 
 	w.WriteHeader(http.StatusOK)
 }
 
+// processGameStatus vie hyväksytyn GSI-paketin tilaan ja kameranvaihtoon. Sama käsittely
+// tehdään observerilta tulleille ja nauhoitukselta toistetuille paketeille.
+func processGameStatus(data *gsi.State, raw []byte, observer string, received time.Time) {
+	packetStats.accept()
+	hub.heartbeat(observer)
+	if data.Auth != nil {
+		// Token ei saa näkyä /lastgsijson-rajapinnassa eikä nauhoituksessa
+		raw = withoutAuth(raw)
+	}
+	store.SetLastGSIJSON(raw)
+	recorder.record(received, observer, raw, "")
+
+	_ = updateGameState(data)
+	_ = updateObserverState(data, received)
+}
+
 func ReportGameState(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
-	s, err := json.MarshalIndent(teams, "", "    ")
+	s, err := store.TeamsJSON(switcher.overrideState(), dryRunScenes())
 	if err != nil {
 		log.Println("Joukkuestatuksen JSON-käännös epäonnistui: ", err)
 	}
@@ -64,78 +135,171 @@ func ReportConfPlayers(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
 
-	s, err := json.MarshalIndent(Players, "", "    ")
+	s, err := json.MarshalIndent(playerStatuses(), "", "    ")
 	if err != nil {
 		log.Println("Pelaajaconfin JSON-käännös epäonnistui: ", err)
 	}
 	w.Write(s)
 }
 
-func ReportLastGSIJSON(w http.ResponseWriter, r *http.Request)  {
+// ReportCameraServers kertoo videolähtöjen tilan
+func ReportCameraServers(w http.ResponseWriter, r *http.Request) {
+	s, err := json.MarshalIndent(outputStatuses(), "", "    ")
+	if err != nil {
+		log.Println("Videolähtöjen tilan JSON-käännös epäonnistui: ", err)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(s)
+}
+
+func ReportLastGSIJSON(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
-	w.Write(lastGSIJSON)
+	w.Write(store.LastGSIJSON())
 }
 
-func getRawPost(r *http.Request) (body []byte) {
-	var err error
-	body, err = ioutil.ReadAll(r.Body)
+// authenticateObserver tarkistaa paketin auth-tokenin ja palauttaa tokenia vastaavan observerin
+// nimen. Jos tokeneita ei ole konfiguroitu, kaikki paketit hyväksytään.
+func authenticateObserver(data *gsi.State) (string, bool) {
+	gsiTokens := store.GSITokens()
+	if len(gsiTokens) == 0 {
+		return "tuntematon", true
+	}
+	if data.Auth == nil {
+		return "", false
+	}
+	for token, observer := range gsiTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(data.Auth.Token)) == 1 {
+			return observer, true
+		}
+	}
+	return "", false
+}
+
+func withoutAuth(raw []byte) []byte {
+	var packet map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &packet); err != nil {
+		return raw
+	}
+	delete(packet, "auth")
+	stripped, err := json.Marshal(packet)
 	if err != nil {
-		log.Fatal(err)
+		return raw
 	}
-	return body
+	return stripped
+}
+
+func getRawPost(r *http.Request) ([]byte, error) {
+	return ioutil.ReadAll(r.Body)
 }
 
-func updateObserverState(data *jsonq.JsonQuery) error {
+// recoverPanics estää yksittäisen pyynnön käsittelyssä tapahtuneen paniikin kaatamasta koko
+// palvelinta. GSI-paketin käsittelyn paniikki lasketaan hylätyksi paketiksi.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if p := recover(); p != nil {
+				log.Printf("Pyynnön %s %s käsittely kaatui: %v\n%s", r.Method, r.URL.Path, p, debug.Stack())
+				if r.URL.Path == "/" {
+					packetStats.reject(rejectPanic)
+				}
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func updateObserverState(data *gsi.State, received time.Time) error {
 	// Varmista että JSON:issa tuli mukana pelaajatieto ja yritä vaihtaa kuvaa ainoastaan jos se löytyy
-	player, err := data.Object("player")
-	if err != nil {
+	if data.Player == nil || data.Player.SteamID == "" {
+		err := errors.New("player-elementti puuttuu")
 		log.Println("GSI JSON player elementin lukeminen epäonnistui: ", err)
-	}
-	if player != nil {
-		SwitchPlayer(player["steamid"].(string))
-		log.Print("Observattavana: \"" + player["steamid"].(string) + "\": {\"player_name\": \"" + player["name"].(string) + "\", \"place\": 0},")
+		return err
 	}
 
-	return err
+	switcher.Request(SteamID64(data.Player.SteamID), received)
+	log.Print("Observattavana: \"" + data.Player.SteamID + "\": {\"player_name\": \"" + data.Player.Name + "\", \"place\": 0},")
+	return nil
 }
 
-func updateGameState(data *jsonq.JsonQuery) error {
-	allPlayers, err := data.Object("allplayers")
-	if err != nil {
+func updateGameState(data *gsi.State) error {
+	if data.AllPlayers == nil {
+		err := errors.New("allplayers-elementti puuttuu")
 		log.Println(err)
-	} else {
-		for k, v := range allPlayers {
-			p := Player{v.(map[string]interface{})["name"].(string), "", 0}
-			switch v.(map[string]interface{})["team"].(string) {
-			case "T":
-				teams["T"][k] = p
-			case "CT":
-				teams["CT"][k] = p
-			}
-		}
+		return err
 	}
 
-	return err
+	store.UpdateTeams(data.AllPlayers)
+	return nil
 }
 
-func setup() {
-	pConfFilename := flag.String("conf", "pkm.json", "JSON konfiguraatiotiedosto yleisille asetuksille")
+// setup lukee komentorivin ja konfiguraation sekä avaa yhteydet OBS-palvelimiin. Komentokohtaiset
+// vivut määritellään flags-joukkoon ennen kutsua.
+func setup(flags *flag.FlagSet, args []string) {
+	pConfFilename := flags.String("conf", "pkm.json", "JSON konfiguraatiotiedosto yleisille asetuksille")
 
 	obsConfig := Config{}
-	obsConfig.TeamAFile = flag.String("A", "", "JSON konfiguraatiotiedosto A-tiimille")
-	obsConfig.TeamBFile = flag.String("B", "", "JSON konfiguraatiotiedosto B-tiimille")
-	obsConfig.TestOnly = flag.Bool("test", false, "testaa palvelinsovellusta paikallisesti lähettämättä ohjauskomentoja")
-	flag.Parse()
+	obsConfig.TeamAFile = flags.String("A", "", "JSON konfiguraatiotiedosto A-tiimille")
+	obsConfig.TeamBFile = flags.String("B", "", "JSON konfiguraatiotiedosto B-tiimille")
+	obsConfig.DryRun = flags.Bool("dry-run", false, "kuivaharjoitus: OBS-palvelimiin ei yhdistetä, vaan kamerat vaihdetaan virtuaalisiin sceneihin, jotka näkyvät /state-rajapinnassa")
+	testOnly := flags.Bool("test", false, "sama kuin -dry-run")
+	obsConfig.Strict = flags.Bool("strict", false, "keskeytä käynnistys, jos OBS-scenejen tarkistuksessa löytyy puuttuvia tai tuplakameroita")
+	recordFile := flags.String("record", "", "nauhoita hyväksytyt GSI-paketit vastaanottoaikoineen NDJSON-tiedostoon")
+	flags.Parse(args)
+	*obsConfig.DryRun = *obsConfig.DryRun || *testOnly
+	activeConfigFiles = configFiles{pkm: *pConfFilename, teamA: *obsConfig.TeamAFile, teamB: *obsConfig.TeamBFile}
 
-	configureGameState()
 	ConfigurePKM(*pConfFilename)
+	configureGSIAuth()
+	configureControl()
+	if *recordFile != "" {
+		if err := recorder.open(*recordFile); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("GSI-paketit nauhoitetaan tiedostoon %s", *recordFile)
+	}
 	ConfigureOBS(obsConfig)
 }
 
-func configureGameState() {
-	teams = make(map[string]map[string]Player)
-	teams["T"] = make(map[string]Player)
-	teams["CT"] = make(map[string]Player)
+func configureGSIAuth() {
+	gsiTokens, err := loadGSITokens(CQ)
+	if err != nil {
+		log.Fatal(err)
+	}
+	store.SetGSITokens(gsiTokens)
+	if len(gsiTokens) == 0 {
+		log.Println("GSI auth-tokeneita ei ole konfiguroitu, kaikki GSI-paketit hyväksytään")
+		return
+	}
+	log.Printf("GSI-paketteja hyväksytään %d observerilta", len(gsiTokens))
+}
+
+// loadGSITokens lukee gsi_auth-listan, jossa jokaisella observer-koneella on oma token. Palautettu
+// kartta yhdistää GSI-paketin auth-tokenin observer-koneen nimeen.
+func loadGSITokens(cq *jsonq.JsonQuery) (map[string]string, error) {
+	gsiTokens := make(map[string]string)
+
+	// Vain puuttuva gsi_auth tarkoittaa, ettei tokeneita tarkisteta. Virheellinen lista ei saa
+	// kytkeä tarkistusta pois.
+	if _, err := cq.Interface("gsi_auth"); err != nil {
+		return gsiTokens, nil
+	}
+	observers, err := cq.ArrayOfObjects("gsi_auth")
+	if err != nil {
+		return nil, fmt.Errorf("Virheellinen gsi_auth-lista, odotettiin listaa observer/token-pareja: %s", err)
+	}
+	for i, o := range observers {
+		observer, _ := o["observer"].(string)
+		token, _ := o["token"].(string)
+		if observer == "" || token == "" {
+			return nil, fmt.Errorf("Virheellinen gsi_auth-merkintä %d, observer ja token ovat pakollisia", i+1)
+		}
+		if other, exists := gsiTokens[token]; exists {
+			return nil, fmt.Errorf("Observereilla %s ja %s on sama GSI auth-token", other, observer)
+		}
+		gsiTokens[token] = observer
+	}
+	return gsiTokens, nil
 }
 
 func listenAddress() string {
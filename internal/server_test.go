@@ -0,0 +1,205 @@
+package internal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+func testRoster(t *testing.T) *Roster {
+	roster := NewRoster()
+	for i := 1; i <= 5; i++ {
+		a := Player{PlayerName: fmt.Sprintf("A%d", i), Camera: fmt.Sprintf("A%d", i), Place: i, Team: "A"}
+		if err := roster.Add(SteamID64(fmt.Sprintf("7656119829354778%d", i)), a); err != nil {
+			t.Fatal(err)
+		}
+		b := Player{PlayerName: fmt.Sprintf("B%d", i), Camera: fmt.Sprintf("B%d", i), Place: i, Team: "B"}
+		if err := roster.Add(SteamID64(fmt.Sprintf("7656119829354777%d", i)), b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return roster
+}
+
+// waitSwitched odottaa, että GSI-pakettien käynnistämät kameranvaihdot on tehty
+func waitSwitched(t *testing.T) {
+	t.Helper()
+	if !switcher.waitIdle(5 * time.Second) {
+		t.Fatal("kameranvaihto ei valmistunut")
+	}
+}
+
+func gsiPacket(observed string, i int) string {
+	return fmt.Sprintf(`{
+		"player": {"steamid": "%s", "name": "pelaaja"},
+		"allplayers": {
+			"76561198293547781": {"name": "A-eka %d", "team": "CT"},
+			"76561198293547771": {"name": "B-eka %d", "team": "T"}
+		}
+	}`, observed, i, i)
+}
+
+// TestConcurrentRequests ajetaan -race -vivulla: GSI-paketit ja tilarajapinnat käsittelevät
+// samaa tilaa rinnakkaisista HTTP-käsittelijöistä
+func TestConcurrentRequests(t *testing.T) {
+	store = newStateStore()
+	store.SetRoster(testRoster(t))
+	outputs = nil
+	cameraOwners = make(map[string]videoOutput)
+
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+
+	observed := []string{"76561198293547781", "76561198293547772", "76561198293547775", "76561198293547773", "tuntematon"}
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				body := gsiPacket(observed[(w+i)%len(observed)], i)
+				resp, err := http.Post(server.URL+"/", "application/json", strings.NewReader(body))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					t.Errorf("GSI-paketin vastaus %d, odotettiin 200", resp.StatusCode)
+				}
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				for _, path := range []string{"/state", "/players", "/lastgsijson", "/status"} {
+					resp, err := http.Get(server.URL + path)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					ioutil.ReadAll(resp.Body)
+					resp.Body.Close()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	waitSwitched(t)
+
+	if current := store.CurrentPlayer(); current == "" {
+		t.Error("yksikään GSI-paketti ei vaihtanut observoitavaa pelaajaa")
+	}
+}
+
+func TestMalformedPacketsAreRejected(t *testing.T) {
+	store = newStateStore()
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+
+	for _, body := range []string{``, `{"player":`, `{"player": {"steamid": 765}}`, `[]`} {
+		resp, err := http.Post(server.URL+"/", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("paketti %q: vastaus %d, odotettiin 400", body, resp.StatusCode)
+		}
+	}
+}
+
+// TestGSIAuth tarkistaa auth-tokenien tarkistuksen: väärä tai puuttuva token hylätään, ja ilman
+// gsi_auth-listaa kaikki paketit hyväksytään
+func TestGSIAuth(t *testing.T) {
+	store = newStateStore()
+	store.SetRoster(testRoster(t))
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+
+	post := func(token string) int {
+		t.Helper()
+		packet := gsiPacket("76561198293547781", 0)
+		if token != "" {
+			packet = strings.Replace(packet, `"player":`, `"auth": {"token": "`+token+`"}, "player":`, 1)
+		}
+		resp, err := http.Post(server.URL+"/", "application/json", strings.NewReader(packet))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	cq, err := DecodeJsonToJsonQ(strings.NewReader(`{"gsi_auth": [
+		{"observer": "observer-1", "token": "salainen-1"},
+		{"observer": "observer-2", "token": "salainen-2"}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := loadGSITokens(cq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.SetGSITokens(tokens)
+
+	if status := post("salainen-2"); status != http.StatusOK {
+		t.Errorf("oikealla tokenilla vastaus %d, odotettiin 200", status)
+	}
+	unauthorized := packetStats.status().Rejected[rejectUnauthorized]
+	for _, token := range []string{"väärä", ""} {
+		if status := post(token); status != http.StatusUnauthorized {
+			t.Errorf("tokenilla %q vastaus %d, odotettiin 401", token, status)
+		}
+	}
+	if n := packetStats.status().Rejected[rejectUnauthorized] - unauthorized; n != 2 {
+		t.Errorf("hylättyjä paketteja %d, odotettiin 2", n)
+	}
+
+	cq, err = DecodeJsonToJsonQ(strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokens, err = loadGSITokens(cq); err != nil || len(tokens) != 0 {
+		t.Fatalf("ilman gsi_auth-listaa tokenit %v, virhe %v", tokens, err)
+	}
+	store.SetGSITokens(tokens)
+	for _, token := range []string{"väärä", ""} {
+		if status := post(token); status != http.StatusOK {
+			t.Errorf("ilman gsi_auth-listaa tokenilla %q vastaus %d, odotettiin 200", token, status)
+		}
+	}
+	waitSwitched(t)
+}
+
+// TestMalformedGSIAuth tarkistaa, ettei virheellinen gsi_auth kytke tokenien tarkistusta pois
+func TestMalformedGSIAuth(t *testing.T) {
+	for _, config := range []string{
+		`{"gsi_auth": {"observer": "observer-1", "token": "salainen"}}`,
+		`{"gsi_auth": ["salainen"]}`,
+		`{"gsi_auth": "salainen"}`,
+		`{"gsi_auth": [{"observer": "observer-1"}]}`,
+		`{"gsi_auth": [{"observer": "observer-1", "token": "x"}, {"observer": "observer-2", "token": "x"}]}`,
+	} {
+		cq, err := DecodeJsonToJsonQ(strings.NewReader(config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tokens, err := loadGSITokens(cq); err == nil {
+			t.Errorf("konfiguraatio %s hyväksyttiin, tokenit %v", config, tokens)
+		}
+	}
+}
@@ -0,0 +1,447 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/pikayem/pkm/internal/gsi"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Simuloidun ottelun säännöt ja ajat kilpailullisen CS:GO:n mukaan (MR15)
+const (
+	simFreezeTime     = 15 * time.Second
+	simRoundTime      = 115 * time.Second
+	simRoundOverTime  = 7 * time.Second
+	simGameOverTime   = 20 * time.Second
+	simHalfRounds     = 15
+	simWinRounds      = 16
+	simKillInterval   = 6 * time.Second
+	simSpectateMin    = 4 * time.Second
+	simSpectateMax    = 12 * time.Second
+	simRequestTimeout = 2 * time.Second
+	simReportInterval = 10 * time.Second
+	simObserverID     = "76561197960265728"
+)
+
+type (
+	simPlayer struct {
+		id    SteamID64
+		name  string
+		team  string
+		slot  int
+		state gsi.PlayerState
+		stats gsi.MatchStats
+	}
+
+	// gameSim on yksinkertainen ottelumalli: erät, tapot, puoliajan puolenvaihto ja observer, joka
+	// vaihtaa katsottavaa pelaajaa välillä itse ja aina katsomansa pelaajan kuollessa
+	gameSim struct {
+		rnd       *rand.Rand
+		players   []*simPlayer
+		sideA     string
+		round     int
+		score     map[string]int
+		mapPhase  string
+		phase     string
+		phaseLeft time.Duration
+		winTeam   string
+		spectated *simPlayer
+		spectate  time.Duration
+	}
+)
+
+// Simulate lähettää ajossa olevalle PKM:lle observerin kaltaisia GSI-paketteja joukkuetiedostojen
+// pelaajista:
+//
+//	pkm simulate -A team2.json -B team1.json [-rate 4] [-speed 1] [-url http://127.0.0.1:1999/]
+func Simulate(args []string) {
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	confFile := flags.String("conf", "pkm.json", "PKM:n konfiguraatio, josta luetaan oletusosoite ja GSI auth-token")
+	teamAFile := flags.String("A", "", "JSON konfiguraatiotiedosto A-tiimille")
+	teamBFile := flags.String("B", "", "JSON konfiguraatiotiedosto B-tiimille")
+	target := flags.String("url", "", "PKM:n GSI-osoite, oletuksena konfiguraation pkm-osoite")
+	token := flags.String("token", "", "GSI auth-token, oletuksena konfiguraation ensimmäinen gsi_auth-token")
+	rate := flags.Float64("rate", 4, "lähetettäviä paketteja sekunnissa")
+	speed := flags.Float64("speed", 1, "pelin nopeus, esim. 10 pelaa erän kymmenessä sekunnissa")
+	duration := flags.Duration("duration", 0, "simuloinnin kesto, 0 = kunnes ohjelma keskeytetään")
+	seed := flags.Int64("seed", 0, "satunnaislukujen siemen, 0 = kellonaika")
+	flags.Parse(args)
+
+	if *teamAFile == "" || *teamBFile == "" {
+		log.Fatal("Käyttö: pkm simulate -A joukkue-a.json -B joukkue-b.json [vivut]")
+	}
+	if *rate <= 0 || *speed <= 0 {
+		log.Fatal("Pakettitahdin ja pelin nopeuden pitää olla positiivisia")
+	}
+	if *target == "" || *token == "" {
+		cq, err := LoadJsonFile(*confFile)
+		if err != nil {
+			log.Fatalf("PKM:n osoitetta ja auth-tokenia ei voitu lukea, anna ne -url ja -token vivuilla: %s", err)
+		}
+		if *target == "" {
+			address := configuredAddress(cq)
+			if strings.HasPrefix(address, "0.0.0.0:") {
+				address = "127.0.0.1" + strings.TrimPrefix(address, "0.0.0.0")
+			}
+			*target = "http://" + address + "/"
+		}
+		if *token == "" {
+			tokens, err := loadGSITokens(cq)
+			if err != nil {
+				log.Fatal(err)
+			}
+			for t := range tokens {
+				*token = t
+				break
+			}
+		}
+	}
+
+	roster, err := loadRoster(*teamAFile, *teamBFile, cameraNaming{template: defaultCameraTemplate})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	sim, err := newGameSim(roster, rand.New(rand.NewSource(*seed)))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Simuloidaan GSI-paketteja osoitteeseen %s, %.1f pakettia sekunnissa, pelin nopeus %.1f", *target, *rate, *speed)
+	interval := time.Duration(float64(time.Second) / *rate)
+	step := time.Duration(float64(interval) * *speed)
+	client := &http.Client{Timeout: simRequestTimeout}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	report := time.NewTicker(simReportInterval)
+	defer report.Stop()
+
+	var sent, failed int
+	var latency time.Duration
+	deadline := time.Now().Add(*duration)
+	for {
+		select {
+		case <-report.C:
+			if sent > 0 {
+				log.Printf("Lähetetty %d pakettia, epäonnistui %d, keskimääräinen vasteaika %s", sent, failed, latency/time.Duration(sent))
+			}
+			continue
+		case <-ticker.C:
+		}
+		if *duration > 0 && time.Now().After(deadline) {
+			break
+		}
+
+		sim.advance(step)
+		body, err := json.Marshal(sim.packet(*token))
+		if err != nil {
+			log.Fatalf("GSI-paketin muodostus epäonnistui: %s", err)
+		}
+		start := time.Now()
+		resp, err := client.Post(*target, "application/json", bytes.NewReader(body))
+		latency += time.Since(start)
+		sent++
+		if err != nil {
+			failed++
+			log.Printf("GSI-paketin lähetys epäonnistui: %s", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			failed++
+			log.Printf("PKM vastasi GSI-pakettiin %s", resp.Status)
+		}
+	}
+	log.Printf("Simulointi päättyi, lähetetty %d pakettia, epäonnistui %d", sent, failed)
+}
+
+func newGameSim(roster *Roster, rnd *rand.Rand) (*gameSim, error) {
+	sim := &gameSim{
+		rnd:      rnd,
+		sideA:    "CT",
+		score:    map[string]int{"A": 0, "B": 0},
+		mapPhase: "live",
+	}
+	roster.Each(func(id SteamID64, p Player) {
+		sim.players = append(sim.players, &simPlayer{id: id, name: p.PlayerName, team: p.Team})
+	})
+	sort.Slice(sim.players, func(i, j int) bool {
+		a, b := sim.players[i], sim.players[j]
+		if a.team != b.team {
+			return a.team < b.team
+		}
+		return a.id < b.id
+	})
+
+	// Observer-paikat 1-5 A-joukkueelle ja 6-9, 0 B-joukkueelle kuten pelissä
+	counts := map[string]int{}
+	for _, p := range sim.players {
+		counts[p.team]++
+		if p.team == "A" {
+			p.slot = counts["A"]
+		} else {
+			p.slot = (5 + counts["B"]) % 10
+		}
+	}
+	if counts["A"] == 0 || counts["B"] == 0 {
+		return nil, fmt.Errorf("molemmissa joukkueissa pitää olla vähintään yksi pelaaja")
+	}
+	sim.startRound()
+	return sim, nil
+}
+
+func (sim *gameSim) side(p *simPlayer) string {
+	if p.team == "A" {
+		return sim.sideA
+	}
+	return otherSide(sim.sideA)
+}
+
+func otherSide(side string) string {
+	if side == "CT" {
+		return "T"
+	}
+	return "CT"
+}
+
+func (sim *gameSim) startRound() {
+	sim.phase = "freezetime"
+	sim.phaseLeft = simFreezeTime
+	sim.winTeam = ""
+	for _, p := range sim.players {
+		p.state.Health = 100
+		p.state.Armor = 100
+		p.state.Helmet = true
+		p.state.RoundKills = 0
+		p.state.RoundKillHS = 0
+		p.state.RoundTotalDmg = 0
+		if p.state.Money < 800 {
+			p.state.Money = 800
+		}
+		p.state.EquipValue = 4000 + sim.rnd.Intn(2000)
+	}
+	log.Printf("Erä %d alkaa, A %d - %d B", sim.round+1, sim.score["A"], sim.score["B"])
+}
+
+func (sim *gameSim) alive(side string) []*simPlayer {
+	var alive []*simPlayer
+	for _, p := range sim.players {
+		if p.state.Health > 0 && (side == "" || sim.side(p) == side) {
+			alive = append(alive, p)
+		}
+	}
+	return alive
+}
+
+// advance siirtää peliä eteenpäin dt:n verran pelin aikaa
+func (sim *gameSim) advance(dt time.Duration) {
+	sim.phaseLeft -= dt
+	switch sim.phase {
+	case "freezetime":
+		if sim.phaseLeft <= 0 {
+			sim.phase = "live"
+			sim.phaseLeft = simRoundTime
+		}
+	case "live":
+		sim.fight(dt)
+		switch {
+		case len(sim.alive("T")) == 0:
+			sim.endRound("CT")
+		case len(sim.alive("CT")) == 0:
+			sim.endRound("T")
+		case sim.phaseLeft <= 0:
+			sim.endRound("CT")
+		}
+	case "over":
+		if sim.phaseLeft > 0 {
+			break
+		}
+		switch sim.mapPhase {
+		case "gameover":
+			log.Println("Ottelu päättyi, aloitetaan uusi ottelu")
+			sim.round = 0
+			sim.score = map[string]int{"A": 0, "B": 0}
+			sim.sideA = "CT"
+			for _, p := range sim.players {
+				p.stats = gsi.MatchStats{}
+				p.state.Money = 800
+			}
+		case "intermission":
+			log.Println("Puoliaika, joukkueet vaihtavat puolia")
+			sim.sideA = otherSide(sim.sideA)
+			for _, p := range sim.players {
+				p.state.Money = 800
+			}
+		}
+		sim.mapPhase = "live"
+		sim.startRound()
+	}
+
+	sim.spectate -= dt
+	if sim.spectated == nil || sim.spectate <= 0 {
+		sim.spectateRandom()
+	}
+}
+
+// fight arpoo erän tapahtumat: osumia ja keskimäärin yhden tapon simKillInterval-välein
+func (sim *gameSim) fight(dt time.Duration) {
+	if sim.rnd.Float64() < dt.Seconds()/simKillInterval.Seconds() {
+		ct, t := sim.alive("CT"), sim.alive("T")
+		if len(ct) == 0 || len(t) == 0 {
+			return
+		}
+		killer, victim := ct[sim.rnd.Intn(len(ct))], t[sim.rnd.Intn(len(t))]
+		if sim.rnd.Intn(2) == 0 {
+			killer, victim = victim, killer
+		}
+		sim.kill(killer, victim)
+		return
+	}
+	if sim.rnd.Float64() < dt.Seconds() {
+		alive := sim.alive("")
+		p := alive[sim.rnd.Intn(len(alive))]
+		damage := 10 + sim.rnd.Intn(40)
+		if damage >= p.state.Health {
+			damage = p.state.Health - 1
+		}
+		p.state.Health -= damage
+		p.state.Armor = p.state.Armor / 2
+	}
+}
+
+func (sim *gameSim) kill(killer, victim *simPlayer) {
+	killer.state.RoundKills++
+	killer.state.RoundTotalDmg += victim.state.Health
+	killer.state.Money += 300
+	killer.stats.Kills++
+	killer.stats.Score += 2
+	if sim.rnd.Intn(3) == 0 {
+		killer.state.RoundKillHS++
+	}
+	victim.state.Health = 0
+	victim.state.Armor = 0
+	victim.state.EquipValue = 0
+	victim.stats.Deaths++
+
+	// Observer seuraa katsomansa pelaajan tappajaa, kuten observerit yleensä
+	if sim.spectated == victim {
+		sim.setSpectated(killer)
+	}
+}
+
+func (sim *gameSim) endRound(winSide string) {
+	sim.round++
+	sim.phase = "over"
+	sim.phaseLeft = simRoundOverTime
+	sim.winTeam = winSide
+	winner := "A"
+	if sim.sideA != winSide {
+		winner = "B"
+	}
+	sim.score[winner]++
+
+	var mvp *simPlayer
+	for _, p := range sim.players {
+		if sim.side(p) == winSide {
+			p.state.Money += 3250
+			if mvp == nil || p.state.RoundKills > mvp.state.RoundKills {
+				mvp = p
+			}
+		} else {
+			p.state.Money += 1400
+		}
+		if p.state.Money > 16000 {
+			p.state.Money = 16000
+		}
+	}
+	mvp.stats.MVPs++
+	log.Printf("Erän %d voitti %s (%s), A %d - %d B", sim.round, winner, winSide, sim.score["A"], sim.score["B"])
+
+	switch {
+	case sim.score[winner] == simWinRounds:
+		sim.mapPhase = "gameover"
+		sim.phaseLeft = simGameOverTime
+	case sim.round == simHalfRounds:
+		sim.mapPhase = "intermission"
+	}
+}
+
+func (sim *gameSim) spectateRandom() {
+	alive := sim.alive("")
+	if len(alive) == 0 {
+		alive = sim.players
+	}
+	sim.setSpectated(alive[sim.rnd.Intn(len(alive))])
+}
+
+func (sim *gameSim) setSpectated(p *simPlayer) {
+	sim.spectated = p
+	sim.spectate = simSpectateMin + time.Duration(sim.rnd.Int63n(int64(simSpectateMax-simSpectateMin)))
+}
+
+func (sim *gameSim) packet(token string) *gsi.State {
+	ctSide, tSide := "A", "B"
+	if sim.sideA == "T" {
+		ctSide, tSide = "B", "A"
+	}
+	state := &gsi.State{
+		Provider: &gsi.Provider{
+			Name:      "Counter-Strike: Global Offensive",
+			AppID:     730,
+			Version:   13800,
+			SteamID:   simObserverID,
+			Timestamp: time.Now().Unix(),
+		},
+		Map: &gsi.Map{
+			Mode:   "competitive",
+			Name:   "de_inferno",
+			Phase:  sim.mapPhase,
+			Round:  sim.round,
+			TeamCT: gsi.Team{Score: sim.score[ctSide], TimeoutsRemaining: 1},
+			TeamT:  gsi.Team{Score: sim.score[tSide], TimeoutsRemaining: 1},
+		},
+		Round:      &gsi.Round{Phase: sim.phase, WinTeam: sim.winTeam},
+		AllPlayers: make(map[string]gsi.Player, len(sim.players)),
+		PhaseCountdowns: &gsi.PhaseCountdowns{
+			Phase:       sim.phase,
+			PhaseEndsIn: strconv.FormatFloat(sim.phaseLeft.Seconds(), 'f', 1, 64),
+		},
+	}
+	for _, p := range sim.players {
+		state.AllPlayers[string(p.id)] = sim.gsiPlayer(p, false)
+	}
+	player := sim.gsiPlayer(sim.spectated, true)
+	state.Player = &player
+	if token != "" {
+		state.Auth = &gsi.Auth{Token: token}
+	}
+	return state
+}
+
+func (sim *gameSim) gsiPlayer(p *simPlayer, spectated bool) gsi.Player {
+	slot := p.slot
+	state := p.state
+	stats := p.stats
+	gp := gsi.Player{
+		Name:         p.name,
+		ObserverSlot: &slot,
+		Team:         sim.side(p),
+		State:        &state,
+		MatchStats:   &stats,
+	}
+	if spectated {
+		gp.SteamID = string(p.id)
+		gp.Activity = "playing"
+	}
+	return gp
+}
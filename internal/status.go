@@ -0,0 +1,96 @@
+package internal
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// GSI-pakettien hylkäyssyyt
+const (
+	rejectMethod       = "method"
+	rejectReadError    = "read_error"
+	rejectMalformed    = "malformed"
+	rejectUnauthorized = "unauthorized"
+	rejectPanic        = "panic"
+)
+
+type (
+	// gsiStats laskee vastaanotetut ja hylätyt GSI-paketit
+	gsiStats struct {
+		mu         sync.Mutex
+		received   int
+		accepted   int
+		rejected   map[string]int
+		lastPacket time.Time
+	}
+
+	gsiStatus struct {
+		Received   int            `json:"received"`
+		Accepted   int            `json:"accepted"`
+		Rejected   map[string]int `json:"rejected"`
+		LastPacket *time.Time     `json:"last_packet,omitempty"`
+	}
+
+	pkmStatus struct {
+		GSI           gsiStatus      `json:"gsi"`
+		CameraServers []outputStatus `json:"camera_servers"`
+	}
+)
+
+var packetStats = &gsiStats{rejected: make(map[string]int)}
+
+func (gs *gsiStats) receive() {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	gs.received++
+}
+
+func (gs *gsiStats) accept() {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	gs.accepted++
+	gs.lastPacket = time.Now()
+}
+
+func (gs *gsiStats) reject(reason string) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	gs.rejected[reason]++
+}
+
+func (gs *gsiStats) status() gsiStatus {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	s := gsiStatus{
+		Received: gs.received,
+		Accepted: gs.accepted,
+		Rejected: make(map[string]int, len(gs.rejected)),
+	}
+	for reason, count := range gs.rejected {
+		s.Rejected[reason] = count
+	}
+	if !gs.lastPacket.IsZero() {
+		last := gs.lastPacket
+		s.LastPacket = &last
+	}
+	return s
+}
+
+// ReportStatus kertoo GSI-pakettien tilastot ja videolähtöjen tilan
+func ReportStatus(w http.ResponseWriter, r *http.Request) {
+	status := pkmStatus{
+		GSI:           packetStats.status(),
+		CameraServers: outputStatuses(),
+	}
+
+	s, err := json.MarshalIndent(status, "", "    ")
+	if err != nil {
+		log.Println("Tilatietojen JSON-käännös epäonnistui: ", err)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(s)
+}
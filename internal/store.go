@@ -0,0 +1,153 @@
+package internal
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/pikayem/pkm/internal/gsi"
+)
+
+// stateStore omistaa HTTP-käsittelijöiden, kameranvaihdon ja OBS-valvonnan jakaman tilan.
+// Roster julkaistaan aina kokonaan uutena eikä sitä muokata julkaisun jälkeen, joten
+// Roster():n palauttamaa rosteria voi lukea ilman lukitusta.
+type stateStore struct {
+	mu               sync.RWMutex
+	roster           *Roster
+	teams            map[string]map[string]Player
+	lastGSIJSON      []byte
+	currentPlayerSID SteamID64
+	// gsiTokens yhdistää GSI-paketin auth-tokenin observer-koneen nimeen, julkaistaan kuten roster
+	gsiTokens map[string]string
+	// controlToken suojaa ohjausrajapinnat, ks. requireControl
+	controlToken string
+	// Ajon aikana käytöstä poistetut kamerat. Säilyvät konfiguraation uudelleenlatauksen yli.
+	disabledCameras map[string]bool
+}
+
+var store = newStateStore()
+
+func newStateStore() *stateStore {
+	return &stateStore{
+		roster:          NewRoster(),
+		disabledCameras: make(map[string]bool),
+		teams: map[string]map[string]Player{
+			"T":  make(map[string]Player),
+			"CT": make(map[string]Player),
+		},
+	}
+}
+
+func (s *stateStore) Roster() *Roster {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.roster
+}
+
+func (s *stateStore) SetRoster(roster *Roster) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.roster = roster
+}
+
+func (s *stateStore) GSITokens() map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.gsiTokens
+}
+
+func (s *stateStore) SetGSITokens(tokens map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gsiTokens = tokens
+}
+
+func (s *stateStore) ControlToken() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.controlToken
+}
+
+func (s *stateStore) SetControlToken(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.controlToken = token
+}
+
+// CurrentPlayer palauttaa lähetyksessä olevan pelaajan SteamID:n. Tyhjä arvo tarkoittaa, ettei
+// kameroita ole vielä ohjattu ja "0" sitä, että observoitavaa pelaajaa ei tunneta.
+func (s *stateStore) CurrentPlayer() SteamID64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.currentPlayerSID
+}
+
+func (s *stateStore) SetCurrentPlayer(steamId SteamID64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.currentPlayerSID = steamId
+}
+
+func (s *stateStore) CameraDisabled(camera string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.disabledCameras[camera]
+}
+
+// SetCameraDisabled poistaa kameran käytöstä tai palauttaa sen käyttöön ja kertoo muuttuiko tila
+func (s *stateStore) SetCameraDisabled(camera string, disabled bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.disabledCameras[camera] == disabled {
+		return false
+	}
+	if disabled {
+		s.disabledCameras[camera] = true
+	} else {
+		delete(s.disabledCameras, camera)
+	}
+	return true
+}
+
+// UpdateTeams päivittää GSI:n allplayers-listan pelaajat puolen mukaan
+func (s *stateStore) UpdateTeams(allPlayers map[string]gsi.Player) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for steamId, v := range allPlayers {
+		p := Player{PlayerName: v.Name}
+		switch v.Team {
+		case "T":
+			s.teams["T"][steamId] = p
+		case "CT":
+			s.teams["CT"][steamId] = p
+		}
+	}
+}
+
+// TeamsJSON palauttaa /state-rajapinnan JSON-olion: GSI:ssä nähdyt pelaajat puolittain ("T" ja
+// "CT"), käsiohjauksen tila sekä kuivaharjoituksessa virtuaaliset scenet
+func (s *stateStore) TeamsJSON(override overrideState, scenes []dryRunScene) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	state := map[string]interface{}{
+		"T":        s.teams["T"],
+		"CT":       s.teams["CT"],
+		"override": override,
+	}
+	if scenes != nil {
+		state["dry_run"] = scenes
+	}
+	return json.MarshalIndent(state, "", "    ")
+}
+
+func (s *stateStore) SetLastGSIJSON(raw []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastGSIJSON = raw
+}
+
+func (s *stateStore) LastGSIJSON() []byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lastGSIJSON
+}
@@ -0,0 +1,212 @@
+package internal
+
+import (
+	"fmt"
+	"github.com/jmoiron/jsonq"
+	"log"
+	"sync"
+	"time"
+)
+
+// cameraSwitcher suodattaa observerin nopeat pelaajavaihdot ennen SwitchPlayer-kutsua.
+// Uusi valinta viedään lähetykseen vasta kun se on pysynyt samana settle-ajan ja edellinen
+// kamera on ollut näkyvissä vähintään minHold-ajan. Viimeisin valinta voittaa aina.
+//
+// Päätökset tehdään cs.mu:n suojaamina, mutta itse vaihdon tekee oma goroutine ilman cs.mu:ta,
+// jotta hidas videolähtö tai häivytys ei pysäytä GSI-pakettien käsittelyä eikä tilarajapintoja.
+type cameraSwitcher struct {
+	mu      sync.Mutex
+	settle  time.Duration
+	minHold time.Duration
+
+	// target on observerin viimeisin valinta ja onAir lähetyksessä oleva pelaaja
+	target      SteamID64
+	targetSince time.Time
+	// Valinnan tuoneen GSI-paketin vastaanottoaika viiveen mittaamiseen, nolla jos ei mitata
+	targetReceived time.Time
+	onAir          SteamID64
+	onAirSince     time.Time
+	timer          *time.Timer
+
+	// Tuottajan käsiohjaus, ks. override.go. Käsiohjauksen aikana observerin valinnat vain kirjataan.
+	override      string
+	overrideSince time.Time
+
+	// order on viimeisin vaihtopäätös, jota vaihtogoroutine ei ole vielä ottanut. Uusi päätös
+	// korvaa aiemman, joten goroutine vaihtaa aina viimeisimpään päätökseen.
+	order *switchOrder
+	wake  chan struct{}
+	// busy kertoo vaihtogoroutinen olevan kesken vaihdon
+	busy bool
+}
+
+// switchOrder on vaihtogoroutinelle annettu vaihto
+type switchOrder struct {
+	player SteamID64
+	// Viiveen mittauksen alku: valinnan tuoneen GSI-paketin vastaanotto tai switching-viiveiden
+	// päättyminen, nolla jos ei mitata
+	issued time.Time
+	// refresh tekee vaihdon uudelleen, vaikka pelaaja on jo lähetyksessä: hänen kameransa
+	// poistettiin käytöstä tai palautettiin käyttöön
+	refresh bool
+}
+
+var switcher = &cameraSwitcher{override: overrideAuto}
+
+// loadSwitching lukee switching-asetukset. Oletuksena viiveitä ei ole ja kamera vaihtuu heti.
+func loadSwitching(cq *jsonq.JsonQuery) (settle, minHold time.Duration, err error) {
+	if ms, err := cq.Int("switching", "settle_ms"); err == nil {
+		settle = time.Duration(ms) * time.Millisecond
+	}
+	if ms, err := cq.Int("switching", "min_hold_ms"); err == nil {
+		minHold = time.Duration(ms) * time.Millisecond
+	}
+	if settle < 0 || minHold < 0 {
+		return 0, 0, fmt.Errorf("switching-viiveet eivät voi olla negatiivisia")
+	}
+	return settle, minHold, nil
+}
+
+// setDelays vaihtaa viiveet. Kutsujalla on cs.mu.
+func (cs *cameraSwitcher) setDelays(settle, minHold time.Duration) {
+	cs.settle = settle
+	cs.minHold = minHold
+}
+
+// Request kirjaa observerin valitseman pelaajan ja vaihtaa kameran heti, jos viiveet sen sallivat.
+// received on valinnan tuoneen GSI-paketin vastaanottoaika.
+func (cs *cameraSwitcher) Request(playerSID SteamID64, received time.Time) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	now := time.Now()
+	if playerSID != cs.target {
+		cs.target = playerSID
+		cs.targetSince = now
+		cs.targetReceived = received
+		hub.publish(eventObservedPlayer, observedPlayerEvent(playerSID))
+		if cs.override != overrideAuto {
+			// Kirjataan vain valinnan vaihtuessa, koska paketteja tulee useita sekunnissa
+			log.Printf("Käsiohjaus päällä (%s), observerin valinta %s otetaan käyttöön vasta käsiohjauksen päättyessä", cs.override, playerSID)
+		}
+	}
+	cs.apply(now)
+}
+
+func (cs *cameraSwitcher) fire() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.apply(time.Now())
+}
+
+// apply päättää kameranvaihdosta tai ajastaa sen. Kutsujalla on cs.mu.
+func (cs *cameraSwitcher) apply(now time.Time) {
+	if cs.timer != nil {
+		cs.timer.Stop()
+		cs.timer = nil
+	}
+	if cs.target == cs.onAir || cs.override != overrideAuto {
+		return
+	}
+
+	// due on hetki, jolloin switching-viiveet sallivat vaihdon
+	due := cs.targetSince.Add(cs.settle)
+	if held := cs.onAirSince.Add(cs.minHold); held.After(due) {
+		due = held
+	}
+	if wait := due.Sub(now); wait > 0 {
+		cs.timer = time.AfterFunc(wait, cs.fire)
+		return
+	}
+
+	if cs.settle > 0 || cs.minHold > 0 {
+		log.Printf("Pelaajavalinta %s vakiintui, vaihdetaan kamera", cs.target)
+	}
+	// Tahallinen odotus ei kuulu GSI-OBS-viiveeseen, joten viivästetty vaihto mitataan viiveiden päättymisestä
+	issued := cs.targetReceived
+	if !issued.IsZero() && due.After(issued) {
+		issued = due
+	}
+	cs.issue(cs.target, issued)
+	cs.onAir = cs.target
+	cs.onAirSince = now
+}
+
+// issue antaa vaihdon vaihtogoroutinelle. Kutsujalla on cs.mu.
+func (cs *cameraSwitcher) issue(player SteamID64, issued time.Time) {
+	cs.order = &switchOrder{player: player, issued: issued}
+	cs.wakeRunner()
+}
+
+// wakeRunner herättää vaihtogoroutinen ja käynnistää sen ensimmäisellä kerralla. Kutsujalla on cs.mu.
+func (cs *cameraSwitcher) wakeRunner() {
+	if cs.wake == nil {
+		cs.wake = make(chan struct{}, 1)
+		go cs.run(cs.wake)
+	}
+	select {
+	case cs.wake <- struct{}{}:
+	default:
+		// Goroutine on jo herätetty ja ottaa uusimman päätöksen
+	}
+}
+
+// run tekee vaihdot yksi kerrallaan päätösjärjestyksessä
+func (cs *cameraSwitcher) run(wake chan struct{}) {
+	for range wake {
+		cs.mu.Lock()
+		order := cs.order
+		cs.order = nil
+		cs.busy = order != nil
+		cs.mu.Unlock()
+		if order == nil {
+			continue
+		}
+
+		// Viive mitataan vaihtokomentoihin, häivytyksen loppuosa ei kuulu siihen
+		finishFade := switchPlayer(order.player, order.refresh)
+		if !order.issued.IsZero() {
+			metrics.switchLatency(time.Since(order.issued))
+		}
+		if finishFade != nil {
+			finishFade()
+		}
+
+		cs.mu.Lock()
+		cs.busy = false
+		cs.mu.Unlock()
+	}
+}
+
+// cameraChanged päivittää lähetyksen, kun pelaajan kamera on poistettu käytöstä tai palautettu
+// käyttöön. Muutos tehdään vaihtogoroutinessa, jottei se sekoitu käynnissä olevaan häivytykseen.
+func (cs *cameraSwitcher) cameraChanged(player SteamID64) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if player != cs.onAir {
+		// Muiden pelaajien kameroiden tila tarkistetaan, kun ne vaihdetaan lähetykseen
+		return
+	}
+	cs.order = &switchOrder{player: player, refresh: true}
+	cs.wakeRunner()
+}
+
+// waitIdle odottaa enintään timeout-ajan, ettei vaihtoja ole kesken eikä odottamassa
+// vaihtogoroutinea. Viiveiden takia ajastettuja vaihtoja ei odoteta.
+func (cs *cameraSwitcher) waitIdle(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		cs.mu.Lock()
+		idle := cs.order == nil && !cs.busy
+		cs.mu.Unlock()
+		if idle {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
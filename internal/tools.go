@@ -10,58 +10,88 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
 	apikeyFilename                = "steam.apikey"
 	steamWebAPIGetPlayerSummaries = "https://api.steampowered.com/ISteamUser/GetPlayerSummaries/v0002/"
+	// steamWebAPITimeout rajaa tarkistuksen keston, koska uudelleenlataus odottaa sitä
+	steamWebAPITimeout = 5 * time.Second
+)
+
+var steamClient = &http.Client{Timeout: steamWebAPITimeout}
+
+// SteamID- ja SteamID3-muodot tarkistetaan ennen muunnosta, koska steamid-kirjasto kaatuu
+// virheellisiin tunnisteisiin
+var (
+	steamIDPattern  = regexp.MustCompile(`^(?i:STEAM)_[0-5]:[01]:[0-9]{1,10}$`)
+	steamID3Pattern = regexp.MustCompile(`^\[?(?i:U):1:[0-9]{1,10}\]?$`)
 )
 
 var (
 	CQ *jsonq.JsonQuery
 )
 
+// ConfigurePKM lataa yleiset asetukset. Virheellinen konfiguraatio keskeyttää käynnistyksen.
 func ConfigurePKM(filename string) {
-	CQ = LoadJsonFile(filename)
+	var err error
+	CQ, err = LoadJsonFile(filename)
+	if err != nil {
+		log.Fatal(err)
+	}
 }
 
-func LoadJsonFile(filename string) *jsonq.JsonQuery {
+func LoadJsonFile(filename string) (*jsonq.JsonQuery, error) {
 	file, err := os.Open(filename)
 	if err != nil {
-		log.Fatalf("JSON-tiedoston %s lataaminen epäonnistui: %s", filename, err)
-		return nil
+		return nil, fmt.Errorf("JSON-tiedoston %s lataaminen epäonnistui: %s", filename, err)
 	}
-	return DecodeJsonToJsonQ(file)
+	defer file.Close()
+
+	jq, err := DecodeJsonToJsonQ(file)
+	if err != nil {
+		return nil, fmt.Errorf("JSON-tiedoston %s lukeminen epäonnistui: %s", filename, err)
+	}
+	return jq, nil
 }
 
-func DecodeJsonToJsonQ(reader io.Reader) *jsonq.JsonQuery {
-	var err error
+func DecodeJsonToJsonQ(reader io.Reader) (*jsonq.JsonQuery, error) {
 	decoder := json.NewDecoder(reader)
 	jsonStructure := map[string]interface{}{}
-	err = decoder.Decode(&jsonStructure)
-	if err != nil {
-		log.Fatalf("JSON-rakenteen lukuvirhe: %s", err)
-		return nil
+	if err := decoder.Decode(&jsonStructure); err != nil {
+		return nil, fmt.Errorf("JSON-rakenteen lukuvirhe: %s", err)
 	}
-	return jsonq.NewQuery(jsonStructure)
+	return jsonq.NewQuery(jsonStructure), nil
 }
 
-func UnifySteamId(confSteamId string) string {
+func UnifySteamId(confSteamId string) (SteamID64, error) {
 	// Yhdenmukaista SteamID, SteamID3 tai SteamID32 SteamID64 muotoon
 	var steamId64 steamid.ID64
 	var err error
 
+	if confSteamId == "" {
+		return "", fmt.Errorf("tyhjä SteamID")
+	}
+
 	switch strings.ToUpper(string([]rune(confSteamId)[0])) {
 
 	// SteamID
 	case "S":
+		if !steamIDPattern.MatchString(confSteamId) {
+			return "", fmt.Errorf("SteamID '%s' on virheellinen, odotettiin muotoa STEAM_0:1:12345", confSteamId)
+		}
 		steamId64 = steamid.NewID(confSteamId).To64()
 		break
 
 	// SteamID3, salli vain yksittäisen käyttäjän ID-tyyppi ("U")
-	case "U":
+	case "U", "[":
+		if !steamID3Pattern.MatchString(confSteamId) {
+			return "", fmt.Errorf("SteamID3 '%s' on virheellinen, odotettiin muotoa [U:1:12345]", confSteamId)
+		}
 		steamId64 = steamid.NewID3(confSteamId).To64()
 		break
 
@@ -71,7 +101,7 @@ func UnifySteamId(confSteamId string) string {
 
 		intermediateConfSteamId, err = strconv.Atoi(confSteamId)
 		if err != nil {
-			log.Fatalf("SteamID '%s' näytti SteamID32:lta tai SteamID64:lta, "+
+			return "", fmt.Errorf("SteamID '%s' näytti SteamID32:lta tai SteamID64:lta, "+
 				"mutta kokonaisluvuksi muuttaminen epäonnistui: %s", confSteamId, err)
 		}
 
@@ -82,7 +112,7 @@ func UnifySteamId(confSteamId string) string {
 		}
 	}
 
-	return strconv.Itoa(int(steamId64.Uint64()))
+	return SteamID64(strconv.FormatUint(steamId64.Uint64(), 10)), nil
 }
 
 func VerifySteamId(steamId string) bool {
@@ -91,23 +121,29 @@ func VerifySteamId(steamId string) bool {
 
 	apikey, err = ioutil.ReadFile(apikeyFilename)
 	if err != nil {
-		log.Printf("SteamID:tä %d ei tarkistettu, Steam API-avaintiedostoa '%s' ei voitu avata: %s", steamId, apikeyFilename, err)
+		log.Printf("SteamID:tä %s ei tarkistettu, Steam API-avaintiedostoa '%s' ei voitu avata: %s", steamId, apikeyFilename, err)
 		return false
 	}
 	var resp *http.Response
 	queryUrl := fmt.Sprintf("%s?key=%s&steamids=%s", steamWebAPIGetPlayerSummaries, string(apikey), steamId)
 
-	resp, err = http.Get(queryUrl)
+	resp, err = steamClient.Get(queryUrl)
 	if err != nil {
-		log.Fatalf("HTTPS GET Steam API:in epäonnistui: %s", err)
+		log.Printf("HTTPS GET Steam API:in epäonnistui: %s", err)
+		return false
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode == http.StatusOK {
-		steamUser := DecodeJsonToJsonQ(resp.Body)
+		steamUser, err := DecodeJsonToJsonQ(resp.Body)
+		if err != nil {
+			log.Printf("Steam API-kutsun vastauksen lukeminen epäonnistui: %s", err)
+			return false
+		}
 		players, err := steamUser.Array("response", "players")
 		if err != nil {
-			log.Fatalf("Players-listaa ei voitu parsia Steam API-kutsun vastauksesta: %s", err)
+			log.Printf("Players-listaa ei voitu parsia Steam API-kutsun vastauksesta: %s", err)
+			return false
 		}
 
 		switch len(players) {
@@ -118,7 +154,7 @@ func VerifySteamId(steamId string) bool {
 			name, err := steamUser.String("response", "players", "0", "personaname")
 			if err != nil {
 				log.Printf("Steam-käyttäjänimen parsinta JSON-vastauksesta epäonnistui: %s", err)
-				return  false
+				return false
 			}
 			log.Printf("SteamID %s, käyttäjätunnus %s", steamId, name)
 			return true
@@ -127,7 +163,7 @@ func VerifySteamId(steamId string) bool {
 			return false
 		}
 	} else {
-		log.Printf("API-kutsun suoritus palautti virheen, SteamID:tä ei voitu tarkistaa: %s", resp.StatusCode)
+		log.Printf("API-kutsun suoritus palautti virheen, SteamID:tä ei voitu tarkistaa: %d", resp.StatusCode)
 	}
 	return false
 }
@@ -0,0 +1,16 @@
+package internal
+
+import "testing"
+
+func TestUnifySteamId(t *testing.T) {
+	for _, id := range []string{"STEAM_0:0:86173181", "steam_1:0:86173181", "[U:1:172346362]", "U:1:172346362", "172346362", "76561198132612090"} {
+		if got, err := UnifySteamId(id); err != nil || got != "76561198132612090" {
+			t.Errorf("UnifySteamId(%q) = %q, %v", id, got, err)
+		}
+	}
+	for _, id := range []string{"", "STEAM_0:1", "STEAM_0:1:", "STEAM_0:2:1", "STEAM_0:1:x", "STEAM_0:1:1:1", "[U:1]", "[U:1:abc]", "U:1:", "[G:1:5]", "76561198x"} {
+		if got, err := UnifySteamId(id); err == nil {
+			t.Errorf("UnifySteamId(%q) = %q, odotettiin virhettä", id, got)
+		}
+	}
+}
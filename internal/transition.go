@@ -0,0 +1,134 @@
+package internal
+
+import (
+	"fmt"
+	"github.com/jmoiron/jsonq"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	transitionCut  = "cut"
+	transitionFade = "fade"
+
+	defaultFadeDuration = 300 * time.Millisecond
+	defaultFadeFilter   = "pkm-fade"
+	fadeStepInterval    = 40 * time.Millisecond
+)
+
+// transitionConfig määrää miten pelaajakamerasta toiseen siirrytään. Häivytys tehdään
+// kameralähteisiin lisätyn Color Correction -suodattimen opacity-asetuksella.
+type transitionConfig struct {
+	mode     string
+	duration time.Duration
+	filter   string
+}
+
+var transition = transitionConfig{mode: transitionCut}
+
+// loadTransition lukee transition-asetukset. Oletuksena kamerat vaihdetaan suoraan leikkaamalla.
+func loadTransition(cq *jsonq.JsonQuery) (transitionConfig, error) {
+	t := transitionConfig{mode: transitionCut, duration: defaultFadeDuration, filter: defaultFadeFilter}
+
+	if mode, err := cq.String("transition", "mode"); err == nil {
+		t.mode = mode
+	}
+	if t.mode != transitionCut && t.mode != transitionFade {
+		return t, fmt.Errorf("tuntematon siirtymä %s, sallitut arvot ovat \"%s\" ja \"%s\"", t.mode, transitionCut, transitionFade)
+	}
+	if ms, err := cq.Int("transition", "duration_ms"); err == nil {
+		if ms < 0 {
+			return t, fmt.Errorf("siirtymän kesto ei voi olla negatiivinen")
+		}
+		t.duration = time.Duration(ms) * time.Millisecond
+	}
+	if filter, err := cq.String("transition", "filter"); err == nil {
+		t.filter = filter
+	}
+	return t, nil
+}
+
+// switchCameras tuo uuden kameran näkyviin ja piilottaa vanhan valitulla siirtymällä. Kutsujalla on
+// switchMutex. Häivytyksessä palautetaan funktio, joka vie häivytyksen loppuun ja jota kutsutaan
+// switchMutex vapautettuna, jottei muu tila odota häivytyksen ajan.
+func switchCameras(in, out string) func() {
+	if in != "" {
+		metrics.cameraSwitched(in)
+	}
+	if transition.mode == transitionFade && transition.duration > 0 {
+		return startFade(in, out, transition.duration)
+	}
+
+	// Uusi pelaaja näkyviin
+	setCameraVisibility(in, true)
+	// Vanha pois. Jos uusi pelaaja on pienemmällä numerolla kuin vanha, näkyvä muutos tapahtuu vasta tässä
+	setCameraVisibility(out, false)
+	return nil
+}
+
+// startFade tuo uuden kameran näkyviin läpinäkyvänä ja palauttaa ristihäivytyksen loppuosan. Jokainen
+// askel lähetetään molempien kameroiden lähdöille yhtä aikaa, ja seuraava askel otetaan vasta kun
+// kumpikin on vastannut, jotta eri lähdöillä olevat kamerat pysyvät tahdissa. Askeleiden välillä
+// switchMutex on vapaana.
+func startFade(in, out string, duration time.Duration) func() {
+	if in != "" {
+		setCameraOpacity(in, 0)
+		setCameraVisibility(in, true)
+	}
+	return func() {
+		fadeCameras(in, out, duration)
+	}
+}
+
+func fadeCameras(in, out string, duration time.Duration) {
+	steps := int(duration / fadeStepInterval)
+	if steps < 1 {
+		steps = 1
+	}
+	for step := 1; step <= steps; step++ {
+		time.Sleep(duration / time.Duration(steps))
+		level := float64(step) / float64(steps)
+
+		switchMutex.Lock()
+		var wg sync.WaitGroup
+		if in != "" {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				setCameraOpacity(in, level)
+			}()
+		}
+		if out != "" {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				setCameraOpacity(out, 1-level)
+			}()
+		}
+		wg.Wait()
+		switchMutex.Unlock()
+	}
+
+	if out != "" {
+		switchMutex.Lock()
+		setCameraVisibility(out, false)
+		setCameraOpacity(out, 1)
+		switchMutex.Unlock()
+	}
+}
+
+// setCameraOpacity asettaa kameran läpinäkyvyyden, jos kameran lähtö osaa häivyttää
+func setCameraOpacity(camera string, opacity float64) {
+	if camera == "" {
+		return
+	}
+	owner := cameraOwners[camera]
+	if owner == nil {
+		log.Printf("Kameraa %s ei ole millään videolähdöllä, läpinäkyvyyttä ei muutettu", camera)
+		return
+	}
+	if f, ok := owner.(opacityOutput); ok {
+		f.SetOpacity(camera, opacity)
+	}
+}